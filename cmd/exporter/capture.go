@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// A capture is a gzipped tarball of
+//
+//	manifest.json             captureManifest
+//	mountinfo                 bcachefs entries of /proc/self/mountinfo
+//	fs_usage/<target>.txt     output of 'bcachefs fs usage'
+//	sys/fs/bcachefs/<uuid>/   sysfs of the filesystem
+//	sys/block/<name>/         'dev', 'uevent' and 'stat' of the member devices
+const (
+	captureManifestName  = "manifest.json"
+	captureMountInfoName = "mountinfo"
+	captureFsUsageDir    = "fs_usage"
+	captureSysFsDir      = "sys/fs/bcachefs"
+	captureBlockDir      = "sys/block"
+)
+
+type captureManifest struct {
+	Version string          `json:"version"`
+	Time    time.Time       `json:"time"`
+	Targets []captureTarget `json:"targets"`
+}
+
+type captureTarget struct {
+	Path string `json:"path"`
+	Uuid string `json:"uuid"`
+	// file in the capture, empty if 'bcachefs fs usage' was not available
+	FsUsage string `json:"fs_usage,omitempty"`
+}
+
+// runCapture implements 'bcachefs_exporter capture', which saves what the
+// exporter reads from the targets for bug reports.
+func runCapture(args []string) error {
+	fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+	var targets stringSliceFlag
+	fs.Var(&targets, "target", "mount point of the filesystem to capture (can be specified multiple times)")
+	output := fs.String("output", "bcachefs_capture.tar.gz", "path of the capture to write")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("--target is not specified")
+	}
+
+	// the output of the tool is captured as well when it is installed
+	bchBinPath, err := exec.LookPath("bcachefs")
+	if err != nil {
+		log.Warnf("'bcachefs fs usage' is not captured: %v", err)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = writeCapture(context.Background(), f, bchBinPath, targets)
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+	log.Infof("Captured %v to %s", []string(targets), *output)
+	return nil
+}
+
+func writeCapture(ctx context.Context, w io.Writer, bchBinPath string, targets []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	addFile := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	manifest := captureManifest{
+		Version: version.Version,
+		Time:    now,
+		Targets: []captureTarget{},
+	}
+	uuids := []string{}
+	for _, p := range targets {
+		mounted, err := bcachefs.LookupFileSystem(p)
+		if err != nil {
+			return err
+		}
+		t := captureTarget{
+			Path: mounted.MountPoint,
+			Uuid: mounted.Uuid,
+		}
+		if bchBinPath != "" {
+			results, err := exec.CommandContext(ctx, bchBinPath, "fs", "usage", "-f", strings.Join(fsUsageFields, ","), p).Output()
+			if err != nil {
+				log.Warnf("'bcachefs fs usage' of %s is not captured: %v", p, err)
+			} else {
+				t.FsUsage = captureFsUsageName(t.Path)
+				err = addFile(t.FsUsage, results)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		manifest.Targets = append(manifest.Targets, t)
+		uuids = append(uuids, t.Uuid)
+	}
+
+	data, err := os.ReadFile(bcachefs.MOUNTINFO_PATH)
+	if err != nil {
+		return err
+	}
+	mountInfo := []string{}
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.Contains(l, " - bcachefs ") {
+			mountInfo = append(mountInfo, l+"\n")
+		}
+	}
+	err = addFile(captureMountInfoName, []byte(strings.Join(mountInfo, "")))
+	if err != nil {
+		return err
+	}
+
+	for _, uuid := range uuids {
+		err = captureSysFs(tw, uuid, addFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = addFile(captureManifestName, b)
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// captureSysFs adds every readable file of the filesystem in sysfs.
+// The 'block' link of a member device is kept as a link to sys/block,
+// where the files identifying the block device are added.
+func captureSysFs(tw *tar.Writer, uuid string, addFile func(string, []byte) error) error {
+	root := filepath.Join(sysfs.SYSFS_PATH_PREFIX, uuid)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sysfs.SYSFS_PATH_PREFIX, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(captureSysFsDir, rel))
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if d.Name() != "block" {
+				return nil
+			}
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			blockName := filepath.Base(link)
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     name,
+				// from sys/fs/bcachefs/<uuid>/dev-N
+				Linkname: "../../../../block/" + blockName,
+				Mode:     0777,
+			})
+			if err != nil {
+				return err
+			}
+			for _, f := range []string{"dev", "uevent", "stat"} {
+				data, err := os.ReadFile(filepath.Join(p, f))
+				if err != nil {
+					return err
+				}
+				err = addFile(captureBlockDir+"/"+blockName+"/"+f, data)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			// write only files, or the ones the kernel refuses to show
+			log.Debugf("%s is not captured: %v", p, err)
+			return nil
+		}
+		return addFile(name, data)
+	})
+}
+
+func captureFsUsageName(path string) string {
+	return captureFsUsageDir + "/" + strings.ReplaceAll(filepath.Clean(path), "/", "_") + ".txt"
+}
+
+// loadCapture extracts the capture at path into dir and points the
+// readers of sysfs and mountinfo there.
+func loadCapture(path, dir string) (*captureManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = extractCapture(f, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract %s: %v", path, err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, captureManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &captureManifest{}
+	err = json.Unmarshal(b, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", captureManifestName, err)
+	}
+
+	sysfs.SYSFS_PATH_PREFIX = filepath.Join(dir, captureSysFsDir)
+	bcachefs.MOUNTINFO_PATH = filepath.Join(dir, captureMountInfoName)
+	return manifest, nil
+}
+
+// extractCapture extracts the capture in r into dir. Entries are written
+// only where they stay inside dir after the symlinks extracted before them
+// are followed.
+func extractCapture(r io.Reader, dir string) error {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid entry '%s'", hdr.Name)
+		}
+		p := filepath.Join(dir, hdr.Name)
+		// a symlink may point to a directory with another symlink in it,
+		// so where p really is can only be told on the disk
+		err = checkInside(dir, p)
+		if err != nil {
+			return fmt.Errorf("invalid entry '%s': %v", hdr.Name, err)
+		}
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(p, data, 0644)
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !filepath.IsLocal(filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)) {
+				return fmt.Errorf("invalid link '%s' -> '%s'", hdr.Name, hdr.Linkname)
+			}
+			err = os.Symlink(hdr.Linkname, p)
+			if err != nil {
+				return err
+			}
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected type of entry '%s'", hdr.Name)
+		}
+	}
+}
+
+// checkInside returns an error unless p, with the symlinks in the part of
+// it that exists resolved, is inside dir. dir must have no symlinks.
+func checkInside(dir, p string) error {
+	existing := p
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("'%s' is outside of '%s'", resolved, dir)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func captureEntries(t *testing.T, b []byte) map[string]string {
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	res := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res[hdr.Name] = string(data) + hdr.Linkname
+	}
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0", "dev-1")
+	// dev-1 links to its block device as in the real sysfs
+	blockDir := filepath.Join(filepath.Dir(sysfs.SYSFS_PATH_PREFIX), "block", "sde")
+	writeTestFile(t, filepath.Join(blockDir, "dev"), "8:64\n")
+	writeTestFile(t, filepath.Join(blockDir, "uevent"), "MAJOR=8\nMINOR=64\nDEVNAME=sde\nDEVTYPE=disk\n")
+	writeTestFile(t, filepath.Join(blockDir, "stat"), "1 2 3 4 5 6 7 8 9 10 11\n")
+	assert.Nil(os.RemoveAll(filepath.Join(fsDir, "dev-1", "block")))
+	assert.Nil(os.Symlink(blockDir, filepath.Join(fsDir, "dev-1", "block")))
+
+	var buf bytes.Buffer
+	assert.Nil(writeCapture(context.Background(), &buf, "", []string{"/tank"}))
+	entries := captureEntries(t, buf.Bytes())
+	assert.Equal("95 28 8:48 / /tank rw,relatime - bcachefs /dev/sdd rw\n", entries["mountinfo"])
+	assert.Equal("hdd.dev-0\n", entries["sys/fs/bcachefs/"+testUuid+"/dev-0/label"])
+	assert.Equal("8:48\n", entries["sys/fs/bcachefs/"+testUuid+"/dev-0/block/dev"])
+	assert.Equal("../../../../block/sde", entries["sys/fs/bcachefs/"+testUuid+"/dev-1/block"])
+	assert.Equal("8:64\n", entries["sys/block/sde/dev"])
+	assert.Contains(entries["sys/block/sde/uevent"], "DEVNAME=sde\n")
+	assert.Equal("1 2 3 4 5 6 7 8 9 10 11\n", entries["sys/block/sde/stat"])
+	assert.Contains(entries["manifest.json"], `"uuid": "`+testUuid+`"`)
+
+	// replay on a machine without the filesystem
+	setupTestFs(t)
+	p := filepath.Join(t.TempDir(), "capture.tar.gz")
+	writeTestFile(t, p, buf.String())
+	manifest, err := loadCapture(p, t.TempDir())
+	assert.Nil(err)
+	assert.Equal([]captureTarget{{Path: "/tank", Uuid: testUuid}}, manifest.Targets)
+
+	members, err := sysfs.ParseSysFsDevMembers(sysfs.Root(), testUuid)
+	assert.Nil(err)
+	assert.Equal("sde", members[1].BlockDev)
+
+	c := newBcachefsCollector(&settings{
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+		replayFsUsage: map[string]string{},
+		subCollectors: subCollectors,
+	})
+	assert.Equal(map[string]bool{"dev-0": true, "dev-1": true}, collectDevNames(t, c))
+}
+
+func TestExtractCaptureOutside(t *testing.T) {
+	for _, hdr := range []*tar.Header{
+		{Name: "../evil", Typeflag: tar.TypeReg},
+		{Name: "/evil", Typeflag: tar.TypeReg},
+		{Name: "sys/evil", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+	} {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		assert.Nil(t, tw.WriteHeader(hdr))
+		tw.Close()
+		gw.Close()
+		assert.NotNil(t, extractCapture(&buf, t.TempDir()), hdr.Name)
+	}
+}
+
+func TestExtractCaptureChainedSymlinks(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "a/b/c", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "a/b/c/escaped.txt", Typeflag: tar.TypeReg, Size: 4},
+	} {
+		assert.Nil(tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("evil"))
+			assert.Nil(err)
+		}
+	}
+	tw.Close()
+	gw.Close()
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "replay")
+	assert.Nil(os.Mkdir(dir, 0755))
+	assert.NotNil(extractCapture(&buf, dir))
+	assert.NoFileExists(filepath.Join(parent, "escaped.txt"))
+	assert.NoFileExists(filepath.Join(filepath.Dir(parent), "escaped.txt"))
+}
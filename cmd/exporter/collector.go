@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// bcachefsCollector collects bcachefs metrics when it is scraped.
+// Concurrent scrapes share a single in-flight collection, which is
+// cancelled once every scrape waiting on it has gone away.
+type bcachefsCollector struct {
+	parseErrors *prometheus.CounterVec
+
+	// targets of the last collection, used to drop the series of
+	// filesystems which went away. Guarded by mu.
+	lastTargetPaths []string
+
+	mu       sync.Mutex
+	settings *settings
+	inflight *collection
+}
+
+// settings are what a collection runs with. They are replaced as a whole
+// on reload, and a collection keeps the ones it started with.
+type settings struct {
+	bchBinPath string // 'bcachefs' command, empty to use the ioctls
+	// 'bcachefs' command run by the superblock collector
+	showSuperBinPath string
+	fsUsageFields    []string
+	dumpDir          string // where 'bcachefs fs usage' output is saved, empty to disable
+	// captured 'bcachefs fs usage' output of each target, set when replaying
+	replayFsUsage map[string]string
+	timeout       time.Duration
+	labels        prometheus.Labels
+	targets       func() ([]string, error)
+	subCollectors []subCollector
+}
+
+type collection struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	metrics metrics
+}
+
+type metrics []prometheus.Metric
+
+func (m *metrics) gauge(desc *prometheus.Desc, value float64, labelValues ...string) {
+	*m = append(*m, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...))
+}
+
+func (m *metrics) counter(desc *prometheus.Desc, value float64, labelValues ...string) {
+	*m = append(*m, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labelValues...))
+}
+
+// timeStat adds the duration of the events in ts as a summary.
+func (m *metrics) timeStat(desc *prometheus.Desc, ts *sysfs.SysFsTimeStat, labelValues ...string) {
+	quantiles := map[float64]float64{}
+	for _, q := range ts.Quantiles {
+		quantiles[q.Quantile] = q.Value
+	}
+	*m = append(*m, prometheus.MustNewConstSummary(desc, uint64(ts.Count), ts.Duration.Total, quantiles, labelValues...))
+}
+
+// newBcachefsCollector returns a collector for the paths returned by
+// s.targets, which is called at the beginning of every collection.
+func newBcachefsCollector(s *settings) *bcachefsCollector {
+	return &bcachefsCollector{
+		settings: s,
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bcachefs_parse_errors_total",
+			Help: "Number of lines or files which could not be parsed.",
+		},
+			[]string{
+				"mountpoint",
+				"collector",
+				"section",
+			},
+		),
+	}
+}
+
+var allDescs = []*prometheus.Desc{
+	promBchSize,
+	promBchReplicasUsage,
+	promBchDegraded,
+	promBchCompression,
+	promBchBtree,
+	promBchReconcile,
+	promBchDevice,
+	promBchDeviceBuckets,
+	promBchSysFsBtreeWriteStatWrites,
+	promBchSysFsBtreeWriteStatSize,
+	promBchSysFsBtreeCacheSize,
+	promBchSysFsCompressionStat,
+	promBchSysFsRebalanceState,
+	promBchSysFsRebalancePendingWork,
+	promBchSysFsRebalanceStatusKeys,
+	promBchSysFsRebalanceStatusBytes,
+	promBchSysFsTimeStat,
+	promBchSysFsDevStat,
+	promBchSysFsDevInfo,
+	promBchSysFsDevBlockInfo,
+	promBchSysFsDevBlockIos,
+	promBchSysFsDevBlockBytes,
+	promBchSysFsDevBlockIoTime,
+	promBchSysFsDevBlockInFlight,
+	promBchSysFsDevBlockBusy,
+	promBchSysFsDevState,
+	promBchSysFsDevBucketSize,
+	promBchSysFsDevIoDone,
+	promBchSysFsDevIoErrors,
+	promBchSysFsDevIoErrorsRecentWindow,
+	promBchSysFsDevIoLatency,
+	promBchSysFsCounter,
+	promBchFsOptions,
+	promBchFsOptionsInfo,
+	promBchFsDevOptions,
+	promBchFsDevOptionsInfo,
+	promBchErrors,
+	promBchErrorLastTimestamp,
+	promBchSysFsAllocDebug,
+	promBchSysFsAllocWaiting,
+	promBchSysFsDevAllocDebug,
+	promBchSysFsDevAllocWaiting,
+	promBchSysFsDevAllocReserve,
+	promBchSysFsDevAllocBuckets,
+	promBchSysFsDevAllocBytes,
+	promBchSysFsDevAllocFragmented,
+	promBchSbVersionInfo,
+	promBchSbVersionUpgradePending,
+	promBchSbFeature,
+	promBchSbClean,
+	promBchSbSequence,
+	promBchSbMemberInfo,
+	promBchSbMemberLastMount,
+	promBchSbDiskGroupInfo,
+	promBchSbReplicasInfo,
+	promBchSbErrors,
+	promBchSbErrorLastTimestamp,
+	promBchScrapeCollectorSuccess,
+	promBchScrapeCollectorDuration,
+}
+
+// update replaces the settings. Collections in flight are not affected.
+func (c *bcachefsCollector) update(s *settings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings = s
+}
+
+func (c *bcachefsCollector) currentSettings() *settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+func (c *bcachefsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range allDescs {
+		ch <- d
+	}
+	c.parseErrors.Describe(ch)
+}
+
+func (c *bcachefsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch)
+}
+
+// collect joins the in-flight collection, starting one if there is none,
+// and sends its result to ch unless ctx is done first.
+func (c *bcachefsCollector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	col := c.inflight
+	if col == nil {
+		colCtx, cancel := context.WithCancel(context.Background())
+		if c.settings.timeout > 0 {
+			colCtx, cancel = context.WithTimeout(context.Background(), c.settings.timeout)
+		}
+		col = &collection{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.inflight = col
+		go c.run(colCtx, col, c.settings)
+	}
+	col.waiters += 1
+	c.mu.Unlock()
+
+	select {
+	case <-col.done:
+		for _, m := range col.metrics {
+			ch <- m
+		}
+		c.parseErrors.Collect(ch)
+	case <-ctx.Done():
+		log.Warnf("Scrape abandoned: %v", ctx.Err())
+	}
+
+	c.mu.Lock()
+	col.waiters -= 1
+	if col.waiters == 0 {
+		// nobody is waiting anymore; a later scrape must start afresh
+		col.cancel()
+		if c.inflight == col {
+			c.inflight = nil
+		}
+	}
+	c.mu.Unlock()
+}
+
+// run collects every target concurrently. A failing target is logged and
+// skipped so that it does not hide the others.
+func (c *bcachefsCollector) run(ctx context.Context, col *collection, s *settings) {
+	targetPaths, err := s.targets()
+	if err != nil {
+		log.Errorf("Failed to get targets: %v", err)
+	}
+	c.forgetTargets(targetPaths)
+	results := make([]metrics, len(targetPaths))
+	var wg sync.WaitGroup
+	for i, path := range targetPaths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.scrape(ctx, s, path)
+		}()
+	}
+	wg.Wait()
+	for _, m := range results {
+		col.metrics = append(col.metrics, m...)
+	}
+
+	c.mu.Lock()
+	if c.inflight == col {
+		c.inflight = nil
+	}
+	c.mu.Unlock()
+	close(col.done)
+}
+
+// forgetTargets deletes the parse error counters of targets which are no
+// longer collected. Other series are built on every collection and so
+// never outlive their target.
+func (c *bcachefsCollector) forgetTargets(targetPaths []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.lastTargetPaths {
+		if !slices.Contains(targetPaths, p) {
+			log.Infof("Target %s has gone", p)
+			c.parseErrors.DeletePartialMatch(prometheus.Labels{"mountpoint": p})
+		}
+	}
+	c.lastTargetPaths = targetPaths
+}
+
+// scrape runs every sub collector against the filesystem mounted at path.
+// A failing sub collector is logged and reported through
+// bcachefs_scrape_collector_success, and does not stop the others.
+func (c *bcachefsCollector) scrape(ctx context.Context, s *settings, path string) metrics {
+	t := &target{path: path}
+	m := metrics{}
+	var uuidErr error
+	for _, sc := range s.subCollectors {
+		begin := time.Now()
+		var err error
+		if sc.name != "fsusage" && t.uuid == "" {
+			// fsusage is disabled or failed. A failed lookup is not
+			// repeated for each sub collector.
+			if uuidErr == nil {
+				t.uuid, uuidErr = lookupUuid(s, path)
+			}
+			err = uuidErr
+		}
+		if err != nil {
+			err = fmt.Errorf("filesystem uuid is unknown: %v", err)
+		} else if err = ctx.Err(); err == nil {
+			err = sc.collect(ctx, s, t, &m)
+		}
+		duration := time.Since(begin).Seconds()
+
+		success := 1.0
+		if notAvailable(err) {
+			// the running kernel does not provide this component
+			log.Debugf("%s of %s is not available: %v", sc.name, path, err)
+		} else if err != nil {
+			log.Errorf("Collector %s failed for %s: %v", sc.name, path, err)
+			success = 0
+		}
+		for _, pe := range parseErrors(err) {
+			c.parseErrors.WithLabelValues(path, sc.name, pe.Section).Inc()
+		}
+		m.gauge(promBchScrapeCollectorSuccess, success, path, sc.name)
+		m.gauge(promBchScrapeCollectorDuration, duration, path, sc.name)
+	}
+	log.Infof("Parsed %s", t.uuid)
+	return m
+}
+
+// lookupUuid returns the uuid of the filesystem path is in. Any path inside
+// the mount is resolved with BCH_IOCTL_QUERY_UUID, and mountpoints are also
+// looked up in mountinfo, which is the only way when replaying a capture.
+func lookupUuid(s *settings, path string) (string, error) {
+	if s.replayFsUsage == nil {
+		uuid, err := bcachefs.QueryUuid(path)
+		if err == nil {
+			return uuid, nil
+		}
+		log.Debugf("Falling back to mountinfo for %s: %v", path, err)
+	}
+	mounted, err := bcachefs.LookupFileSystem(path)
+	if err != nil {
+		return "", err
+	}
+	return mounted.Uuid, nil
+}
+
+// notAvailable reports whether err only says that something does not
+// exist. A missing file joined with other failures is a failure.
+func notAvailable(err error) bool {
+	if e, ok := err.(interface{ Unwrap() []error }); ok {
+		errs := e.Unwrap()
+		return len(errs) == 1 && notAvailable(errs[0])
+	}
+	if inner := errors.Unwrap(err); inner != nil {
+		return notAvailable(inner)
+	}
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// parseErrors returns every *utils.ParseError in the tree of err.
+func parseErrors(err error) []*utils.ParseError {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *utils.ParseError:
+		return []*utils.ParseError{e}
+	case interface{ Unwrap() []error }:
+		res := []*utils.ParseError{}
+		for _, inner := range e.Unwrap() {
+			res = append(res, parseErrors(inner)...)
+		}
+		return res
+	default:
+		return parseErrors(errors.Unwrap(err))
+	}
+}
+
+// scrapeCollector binds a bcachefsCollector to the context of one HTTP request.
+type scrapeCollector struct {
+	ctx context.Context
+	c   *bcachefsCollector
+}
+
+func (s *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.c.Describe(ch)
+}
+
+func (s *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.collect(s.ctx, ch)
+}
+
+func newMetricsHandler(c *bcachefsCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg := prometheus.NewRegistry()
+		labels := c.currentSettings().labels
+		prometheus.WrapRegistererWith(labels, reg).MustRegister(&scrapeCollector{ctx: r.Context(), c: c})
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, reg}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+			ErrorLog:      log.StandardLogger(),
+			ErrorHandling: promhttp.ContinueOnError,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// dumpOutput saves the raw output of 'bcachefs fs usage' in outputDir
+// for debugging.
+func dumpOutput(outputDir, path string, results []byte) error {
+	err := os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", outputDir, err)
+	}
+	// every target gets its own dump as they are collected concurrently
+	outputFilePath := filepath.Join(outputDir, "output"+strings.ReplaceAll(filepath.Clean(path), "/", "_")+".log")
+	outputFile, err := os.Create(outputFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", outputFilePath, err)
+	}
+	defer outputFile.Close()
+	_, err = outputFile.Write(results)
+	if err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUuid = "a9da1e6e-d4e5-4717-a520-408c8af4b084"
+
+func writeTestFile(t *testing.T, path, data string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testTimeStat = `count:     2
+                       since mount        recent
+duration of events
+  min:                       88 us
+  max:                        2 ms
+  total:                      3 ms
+  mean:                     353 us         11 us
+  stddev:                     2 us          5 us
+time between events
+  min:                       10 ns
+  max:                        9 m
+  mean:                     475 ms       1586 ms
+  stddev:                  1909 ms       1679 us
+`
+
+// setupTestFs creates a sysfs tree with the given member devices and a
+// mountinfo mounting it at /tank
+func setupTestFs(t *testing.T, devs ...string) string {
+	root := t.TempDir()
+	sysfs.SYSFS_PATH_PREFIX = filepath.Join(root, "sys")
+	bcachefs.MOUNTINFO_PATH = filepath.Join(root, "mountinfo")
+	writeTestFile(t, bcachefs.MOUNTINFO_PATH, "95 28 8:48 / /tank rw,relatime - bcachefs /dev/sdd rw\n")
+	for _, dev := range devs {
+		p := filepath.Join(sysfs.SYSFS_PATH_PREFIX, testUuid, dev)
+		writeTestFile(t, filepath.Join(p, "block", "dev"), "8:48\n")
+		writeTestFile(t, filepath.Join(p, "label"), "hdd."+dev+"\n")
+		writeTestFile(t, filepath.Join(p, "uuid"), "uuid-"+dev+"\n")
+		writeTestFile(t, filepath.Join(p, "bucket_size"), "512k\n")
+		writeTestFile(t, filepath.Join(p, "nbuckets"), "100\n")
+		writeTestFile(t, filepath.Join(p, "first_bucket"), "1\n")
+		writeTestFile(t, filepath.Join(p, "durability"), "1\n")
+		writeTestFile(t, filepath.Join(p, "state"), "[rw] ro failed spare\n")
+		writeTestFile(t, filepath.Join(p, "data_allowed"), "journal,btree,user\n")
+		writeTestFile(t, filepath.Join(p, "has_data"), "sb,journal\n")
+		writeTestFile(t, filepath.Join(p, "discard"), "0\n")
+		writeTestFile(t, filepath.Join(p, "io_done"), "read:\nuser        :        4096\nwrite:\nuser        :        8192\n")
+		writeTestFile(t, filepath.Join(p, "io_errors"), "IO errors since filesystem creation\n  read:    0\n  write:   0\n  checksum:0\n")
+		writeTestFile(t, filepath.Join(p, "io_latency_stats_read"), testTimeStat)
+		writeTestFile(t, filepath.Join(p, "io_latency_stats_write"), testTimeStat)
+	}
+	return filepath.Join(sysfs.SYSFS_PATH_PREFIX, testUuid)
+}
+
+func collectDevNames(t *testing.T, c *bcachefsCollector) map[string]bool {
+	ch := make(chan prometheus.Metric, 1024)
+	c.collect(context.Background(), ch)
+	close(ch)
+
+	res := map[string]bool{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range pb.Label {
+			if l.GetName() == "devName" {
+				res[l.GetValue()] = true
+			}
+		}
+	}
+	return res
+}
+
+func TestCollectDropsRemovedDevices(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0", "dev-1")
+	devs := []subCollector{}
+	for _, sc := range subCollectors {
+		if sc.name == "devs" {
+			devs = append(devs, sc)
+		}
+	}
+	c := newBcachefsCollector(&settings{
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+		subCollectors: devs,
+	})
+
+	assert.Equal(map[string]bool{"dev-0": true, "dev-1": true}, collectDevNames(t, c))
+	expected := `
+# HELP bcachefs_scrape_collector_success Whether a collector succeeded.
+# TYPE bcachefs_scrape_collector_success gauge
+bcachefs_scrape_collector_success{collector="devs",mountpoint="/tank"} 1
+`
+	assert.Nil(testutil.CollectAndCompare(c, strings.NewReader(expected), "bcachefs_scrape_collector_success"))
+
+	err := os.RemoveAll(filepath.Join(fsDir, "dev-1"))
+	assert.Nil(err)
+	assert.Equal(map[string]bool{"dev-0": true}, collectDevNames(t, c))
+}
+
+func TestCollectDevState(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "state"), "rw [ro] failed spare\n")
+	c := newBcachefsCollector(&settings{
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+		subCollectors: enabledSubCollectors(map[string]bool{"devs": true}),
+	})
+
+	expected := `
+# HELP bcachefs_sysfs_dev_info Member state, data types allowed and stored, and whether discard is enabled of a device.
+# TYPE bcachefs_sysfs_dev_info gauge
+bcachefs_sysfs_dev_info{data_allowed="journal,btree,user",devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",discard="false",has_data="sb,journal",mountpoint="/tank",state="ro",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 1
+# HELP bcachefs_sysfs_dev_state 1 for the member state a device is in, 0 for the other states.
+# TYPE bcachefs_sysfs_dev_state gauge
+bcachefs_sysfs_dev_state{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",mountpoint="/tank",state="failed",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 0
+bcachefs_sysfs_dev_state{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",mountpoint="/tank",state="ro",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 1
+bcachefs_sysfs_dev_state{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",mountpoint="/tank",state="rw",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 0
+bcachefs_sysfs_dev_state{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",mountpoint="/tank",state="spare",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 0
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "bcachefs_sysfs_dev_info", "bcachefs_sysfs_dev_state")
+	assert.Nil(err)
+}
+
+func TestCollectAllocDebug(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0")
+	writeTestFile(t, filepath.Join(fsDir, "internal", "alloc_debug"), "open buckets allocated  12\nfreelist_wait           waiting\n")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "alloc_debug"), `            buckets         sectors      fragmented
+need_discard      3               8               2
+
+reserves:
+copygc           23
+`)
+	c := newBcachefsCollector(&settings{
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+		subCollectors: enabledSubCollectors(map[string]bool{"allocdebug": true}),
+	})
+
+	expected := `
+# HELP bcachefs_sysfs_alloc_debug Numbers in internal/alloc_debug like capacity and open buckets allocated.
+# TYPE bcachefs_sysfs_alloc_debug gauge
+bcachefs_sysfs_alloc_debug{item="open_buckets_allocated",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 12
+# HELP bcachefs_sysfs_alloc_waiting 1 if something waits on the waitlist in internal/alloc_debug like freelist_wait.
+# TYPE bcachefs_sysfs_alloc_waiting gauge
+bcachefs_sysfs_alloc_waiting{item="freelist_wait",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 1
+# HELP bcachefs_sysfs_dev_alloc_reserve_buckets Buckets of a device reserved for allocations of the watermark.
+# TYPE bcachefs_sysfs_dev_alloc_reserve_buckets gauge
+bcachefs_sysfs_dev_alloc_reserve_buckets{devName="dev-0",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084",watermark="copygc"} 23
+# HELP bcachefs_sysfs_dev_alloc_fragmented_bytes Fragmented bytes of a device by data type in alloc_debug.
+# TYPE bcachefs_sysfs_dev_alloc_fragmented_bytes gauge
+bcachefs_sysfs_dev_alloc_fragmented_bytes{dataType="need_discard",devName="dev-0",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 1024
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "bcachefs_sysfs_alloc_debug", "bcachefs_sysfs_alloc_waiting",
+		"bcachefs_sysfs_dev_alloc_reserve_buckets", "bcachefs_sysfs_dev_alloc_fragmented_bytes")
+	assert.Nil(err)
+}
+
+func TestCollectBlockStat(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "block", "stat"), "1 2 3 4 5 6 7 8 9 10 11\n")
+	c := newBcachefsCollector(&settings{
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+		subCollectors: enabledSubCollectors(map[string]bool{"blockstat": true}),
+	})
+
+	expected := `
+# HELP bcachefs_sysfs_dev_block_ios_total IOs completed by the block device backing a device.
+# TYPE bcachefs_sysfs_dev_block_ios_total counter
+bcachefs_sysfs_dev_block_ios_total{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",direction="discard",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 0
+bcachefs_sysfs_dev_block_ios_total{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",direction="flush",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 0
+bcachefs_sysfs_dev_block_ios_total{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",direction="read",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 1
+bcachefs_sysfs_dev_block_ios_total{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",direction="write",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 5
+# HELP bcachefs_sysfs_dev_block_in_flight IOs in progress on the block device backing a device.
+# TYPE bcachefs_sysfs_dev_block_in_flight gauge
+bcachefs_sysfs_dev_block_in_flight{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 9
+# HELP bcachefs_sysfs_dev_block_busy_seconds_total Time the block device backing a device had IOs in progress.
+# TYPE bcachefs_sysfs_dev_block_busy_seconds_total counter
+bcachefs_sysfs_dev_block_busy_seconds_total{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",mountpoint="/tank",uuid="a9da1e6e-d4e5-4717-a520-408c8af4b084"} 0.01
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected), "bcachefs_sysfs_dev_block_ios_total",
+		"bcachefs_sysfs_dev_block_in_flight", "bcachefs_sysfs_dev_block_busy_seconds_total")
+	assert.Nil(err)
+}
+
+func TestDiscoverTargets(t *testing.T) {
+	assert := assert.New(t)
+	setupTestFs(t, "dev-0")
+	targets, err := discoverTargets([]string{"/tank/", "/pool", "/pool/../pool"})
+	assert.Nil(err)
+	assert.Equal([]string{"/tank", "/pool"}, targets)
+}
+
+func TestLookupUuid(t *testing.T) {
+	assert := assert.New(t)
+	setupTestFs(t, "dev-0")
+	// /tank is only in mountinfo
+	uuid, err := lookupUuid(&settings{}, "/tank")
+	assert.Nil(err)
+	assert.Equal(testUuid, uuid)
+
+	_, err = lookupUuid(&settings{}, t.TempDir())
+	assert.NotNil(err)
+}
+
+func TestNotAvailable(t *testing.T) {
+	assert := assert.New(t)
+	missing := &fs.PathError{Op: "open", Path: "rebalance_status", Err: fs.ErrNotExist}
+	parseErr := utils.NewParseError("io_done", 1, "x", fmt.Errorf("too few fields"))
+	assert.False(notAvailable(nil))
+	assert.True(notAvailable(missing))
+	assert.True(notAvailable(fmt.Errorf("failed to read: %w", errors.Join(missing))))
+	assert.False(notAvailable(errors.Join(missing, parseErr)))
+	assert.False(notAvailable(fmt.Errorf("failed to parse 'dev-0': %w", errors.Join(missing, parseErr))))
+	assert.False(notAvailable(parseErr))
+	assert.Equal([]*utils.ParseError{parseErr}, parseErrors(errors.Join(missing, parseErr)))
+}
+
+func TestForgetTargets(t *testing.T) {
+	assert := assert.New(t)
+	c := newBcachefsCollector(&settings{})
+	c.parseErrors.WithLabelValues("/tank", "devs", "io_done").Inc()
+	c.parseErrors.WithLabelValues("/pool", "devs", "io_done").Inc()
+
+	c.forgetTargets([]string{"/tank", "/pool"})
+	c.forgetTargets([]string{"/tank"})
+
+	assert.Equal(1, testutil.CollectAndCount(c.parseErrors))
+}
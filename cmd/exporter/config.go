@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the content of the file given by --config.file.
+// Flags specified on the command line take precedence over it.
+type config struct {
+	// addresses to serve /metrics on. Changing them requires a restart.
+	ListenAddresses []string `yaml:"listen_addresses"`
+	Targets         []string `yaml:"targets"`
+	// export every mounted bcachefs filesystem in addition to Targets
+	Discover bool `yaml:"discover"`
+	// sub collectors to enable or disable by name
+	Collectors map[string]bool `yaml:"collectors"`
+	// upper bound of a collection, 0 for none
+	ScrapeTimeout time.Duration `yaml:"scrape_timeout"`
+	// static labels added to every bcachefs metric
+	Labels  map[string]string `yaml:"labels"`
+	FsUsage fsUsageConfig     `yaml:"fsusage"`
+	Output  outputConfig      `yaml:"output"`
+}
+
+// restartSettings returns the settings which differ between cur and next
+// and only take effect after restart.
+func restartSettings(cur, next *config) []string {
+	res := []string{}
+	if !slices.Equal(cur.ListenAddresses, next.ListenAddresses) {
+		res = append(res, "listen_addresses")
+	}
+	if cur.Output.Textfile != next.Output.Textfile {
+		res = append(res, "output.textfile")
+	}
+	if cur.Output.Interval != next.Output.Interval {
+		res = append(res, "output.interval")
+	}
+	return res
+}
+
+type fsUsageConfig struct {
+	// 'ioctl' or 'tool'
+	Source string `yaml:"source"`
+	// fields passed to 'bcachefs fs usage -f' when Source is 'tool'
+	Fields []string `yaml:"fields"`
+}
+
+type outputConfig struct {
+	// where the output of 'bcachefs fs usage' is saved, empty to disable
+	DumpDir string `yaml:"dump_dir"`
+	// file the metrics are written to instead of serving them over HTTP
+	Textfile string `yaml:"textfile"`
+	// how often Textfile is written, 0 to write it once and exit
+	Interval time.Duration `yaml:"interval"`
+}
+
+var fsUsageFields = []string{"replicas", "btree", "compression", "rebalance_work", "devices"}
+
+func defaultConfig() *config {
+	return &config{
+		ListenAddresses: []string{":9091"},
+		Targets:         []string{},
+		Collectors:      map[string]bool{},
+		Labels:          map[string]string{},
+		FsUsage: fsUsageConfig{
+			Source: "ioctl",
+			Fields: slices.Clone(fsUsageFields),
+		},
+		Output: outputConfig{
+			DumpDir: filepath.Join("/tmp", "bcachefs_exporter"),
+		},
+	}
+}
+
+// loadConfig reads the configuration file at path on top of the defaults.
+// An empty path returns the defaults.
+func loadConfig(path string) (*config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// validate reports every invalid setting of cfg.
+func (cfg *config) validate() error {
+	errs := []error{}
+	if len(cfg.ListenAddresses) == 0 {
+		errs = append(errs, fmt.Errorf("listen_addresses are empty"))
+	}
+	if len(cfg.Targets) == 0 && !cfg.Discover {
+		errs = append(errs, fmt.Errorf("neither targets nor discover is specified"))
+	}
+	for name := range cfg.Collectors {
+		if !slices.ContainsFunc(subCollectors, func(sc subCollector) bool { return sc.name == name }) {
+			errs = append(errs, fmt.Errorf("unknown collector '%s'", name))
+		}
+	}
+	if cfg.ScrapeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("scrape_timeout is negative"))
+	}
+	if cfg.Output.Interval < 0 {
+		errs = append(errs, fmt.Errorf("output interval is negative"))
+	}
+	if cfg.Output.Interval > 0 && cfg.Output.Textfile == "" {
+		errs = append(errs, fmt.Errorf("output interval is specified without textfile"))
+	}
+	if cfg.FsUsage.Source != "ioctl" && cfg.FsUsage.Source != "tool" {
+		errs = append(errs, fmt.Errorf("invalid fsusage source '%s'", cfg.FsUsage.Source))
+	}
+	if len(cfg.FsUsage.Fields) == 0 {
+		errs = append(errs, fmt.Errorf("fsusage fields are empty"))
+	}
+	for _, f := range cfg.FsUsage.Fields {
+		if !slices.Contains(fsUsageFields, f) {
+			errs = append(errs, fmt.Errorf("unknown fsusage field '%s'", f))
+		}
+	}
+	// invalid names and clashes with the labels of the metrics are caught
+	// by the registry
+	reg := prometheus.WrapRegistererWith(cfg.Labels, prometheus.NewRegistry())
+	err := reg.Register(newBcachefsCollector(&settings{}))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid labels: %v", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// newSettings returns the settings of collections following cfg.
+func newSettings(cfg *config) (*settings, error) {
+	s := &settings{
+		fsUsageFields: cfg.FsUsage.Fields,
+		dumpDir:       cfg.Output.DumpDir,
+		timeout:       cfg.ScrapeTimeout,
+		labels:        cfg.Labels,
+		subCollectors: enabledSubCollectors(cfg.Collectors),
+	}
+
+	fsUsage := slices.ContainsFunc(s.subCollectors, func(sc subCollector) bool { return sc.name == "fsusage" })
+	if fsUsage && cfg.FsUsage.Source == "tool" {
+		var err error
+		s.bchBinPath, err = exec.LookPath("bcachefs")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find command 'bcachefs': %v", err)
+		}
+	}
+	if slices.ContainsFunc(s.subCollectors, func(sc subCollector) bool { return sc.name == "superblock" }) {
+		var err error
+		s.showSuperBinPath, err = exec.LookPath("bcachefs")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find command 'bcachefs' for the superblock collector: %v", err)
+		}
+	}
+
+	targets := cleanTargets(cfg.Targets)
+	if cfg.Discover {
+		s.targets = func() ([]string, error) {
+			return discoverTargets(targets)
+		}
+	} else {
+		s.targets = func() ([]string, error) {
+			return targets, nil
+		}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestFile(t, p, `
+listen_addresses:
+  - "192.0.2.1:9091"
+  - "[2001:db8::1]:9091"
+targets:
+  - /tank
+collectors:
+  timestats: false
+scrape_timeout: 10s
+labels:
+  host: nas
+fsusage:
+  source: tool
+  fields: [replicas, devices]
+output:
+  dump_dir: ""
+`)
+	cfg, err := loadConfig(p)
+	assert.Nil(err)
+	assert.Nil(cfg.validate())
+	assert.Equal([]string{"192.0.2.1:9091", "[2001:db8::1]:9091"}, cfg.ListenAddresses)
+	assert.Equal([]string{"/tank"}, cfg.Targets)
+	assert.False(cfg.Discover)
+	assert.Equal(map[string]bool{"timestats": false}, cfg.Collectors)
+	assert.Equal(10*time.Second, cfg.ScrapeTimeout)
+	assert.Equal(map[string]string{"host": "nas"}, cfg.Labels)
+	assert.Equal(fsUsageConfig{Source: "tool", Fields: []string{"replicas", "devices"}}, cfg.FsUsage)
+	assert.Equal("", cfg.Output.DumpDir)
+
+	enabled := []string{}
+	for _, sc := range enabledSubCollectors(cfg.Collectors) {
+		enabled = append(enabled, sc.name)
+	}
+	assert.NotContains(enabled, "timestats")
+	assert.Contains(enabled, "devs")
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	assert := assert.New(t)
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestFile(t, p, "discover: true\n")
+	cfg, err := loadConfig(p)
+	assert.Nil(err)
+	assert.Nil(cfg.validate())
+	assert.Equal([]string{":9091"}, cfg.ListenAddresses)
+	assert.Equal("ioctl", cfg.FsUsage.Source)
+	assert.Equal(fsUsageFields, cfg.FsUsage.Fields)
+	assert.Equal("/tmp/bcachefs_exporter", cfg.Output.DumpDir)
+
+	_, err = loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NotNil(err)
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestFile(t, p, "target: [/tank]\n")
+	_, err := loadConfig(p)
+	assert.NotNil(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+	cfg := defaultConfig()
+	assert.NotNil(cfg.validate())
+
+	cfg.Targets = []string{"/tank"}
+	assert.Nil(cfg.validate())
+
+	for _, modify := range []func(cfg *config){
+		func(cfg *config) { cfg.ListenAddresses = []string{} },
+		func(cfg *config) { cfg.Collectors["unknown"] = true },
+		func(cfg *config) { cfg.ScrapeTimeout = -time.Second },
+		func(cfg *config) { cfg.FsUsage.Source = "sysfs" },
+		func(cfg *config) { cfg.FsUsage.Fields = []string{} },
+		func(cfg *config) { cfg.FsUsage.Fields = []string{"unknown"} },
+		func(cfg *config) { cfg.Labels["mountpoint"] = "/" },
+		func(cfg *config) { cfg.Labels["invalid-name"] = "x" },
+	} {
+		cfg := defaultConfig()
+		cfg.Targets = []string{"/tank"}
+		modify(cfg)
+		assert.NotNil(cfg.validate())
+	}
+}
+
+func TestUpdateSettings(t *testing.T) {
+	assert := assert.New(t)
+	setupTestFs(t, "dev-0")
+	c := newBcachefsCollector(&settings{
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+	})
+	assert.Equal(map[string]bool{}, collectDevNames(t, c))
+
+	cfg := defaultConfig()
+	cfg.Targets = []string{"/tank"}
+	cfg.Collectors = map[string]bool{"fsusage": false}
+	s, err := newSettings(cfg)
+	assert.Nil(err)
+	c.update(s)
+	assert.Equal(map[string]bool{"dev-0": true}, collectDevNames(t, c))
+}
+
+func TestRestartSettings(t *testing.T) {
+	assert := assert.New(t)
+	cur := &config{ListenAddresses: []string{":9091"}}
+	next := &config{ListenAddresses: []string{":9091"}, Targets: []string{"/tank"}}
+	assert.Empty(restartSettings(cur, next))
+
+	next.ListenAddresses = []string{":9092"}
+	next.Output.Interval = time.Minute
+	assert.Equal([]string{"listen_addresses", "output.interval"}, restartSettings(cur, next))
+	// compared with the last reload, not with the startup
+	assert.Empty(restartSettings(next, next))
+}
+
+func TestNewSettingsCleansTargets(t *testing.T) {
+	assert := assert.New(t)
+	cfg := defaultConfig()
+	cfg.Targets = []string{"/tank", "/tank/", "/pool"}
+	s, err := newSettings(cfg)
+	assert.Nil(err)
+	targets, err := s.targets()
+	assert.Nil(err)
+	assert.Equal([]string{"/tank", "/pool"}, targets)
+}
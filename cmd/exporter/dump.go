@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	"gopkg.in/yaml.v3"
+)
+
+// dumpState is what the exporter parses from a filesystem.
+type dumpState struct {
+	Target        string                             `json:"target"`
+	Uuid          string                             `json:"uuid"`
+	FsUsage       *bcachefs.FsUsage                  `json:"fs_usage"`
+	SysFs         *sysfs.SysFsStat                   `json:"sysfs"`
+	TimeStats     sysfs.SysFsTimeStats               `json:"time_stats"`
+	Devs          map[string]sysfs.SysFsDev          `json:"devs"`
+	BlockStats    map[string]sysfs.SysFsDevBlockStat `json:"block_stats"`
+	Superblock    *bcachefs.Superblock               `json:"superblock,omitempty"`
+	Counters      map[string]sysfs.SysFsCounter      `json:"counters"`
+	Options       map[string]sysfs.SysFsOption       `json:"options"`
+	FsErrors      map[string]sysfs.SysFsError        `json:"fs_errors"`
+	AllocDebug    *sysfs.SysFsAllocDebug             `json:"alloc_debug"`
+	DevAllocDebug map[string]sysfs.SysFsAllocDebug   `json:"dev_alloc_debug"`
+	Errors        []string                           `json:"errors,omitempty"`
+}
+
+// runDump implements 'bcachefs_exporter dump', which prints the parsed
+// state of the targets. The state is printed even if parts of it failed,
+// and the failures are returned.
+func runDump(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	var targets stringSliceFlag
+	fs.Var(&targets, "target", "mount point of the filesystem to dump (can be specified multiple times)")
+	format := fs.String("format", "json", "output format: 'json', 'yaml' or 'table'")
+	source := fs.String("fsusage.source", "ioctl", "how the usage is read: 'ioctl' or 'tool' (runs 'bcachefs fs usage')")
+	superblock := fs.Bool("superblock", false, "also dump the superblock (runs 'bcachefs show-super')")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("--target is not specified")
+	}
+	if !slices.Contains([]string{"json", "yaml", "table"}, *format) {
+		return fmt.Errorf("invalid format '%s'", *format)
+	}
+	s := &settings{fsUsageFields: fsUsageFields}
+	switch *source {
+	case "ioctl":
+	case "tool":
+		s.bchBinPath, err = exec.LookPath("bcachefs")
+		if err != nil {
+			return fmt.Errorf("failed to find command 'bcachefs': %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid fsusage source '%s'", *source)
+	}
+	if *superblock {
+		s.showSuperBinPath, err = exec.LookPath("bcachefs")
+		if err != nil {
+			return fmt.Errorf("failed to find command 'bcachefs': %v", err)
+		}
+	}
+
+	states := []*dumpState{}
+	errs := []error{}
+	for _, t := range targets {
+		state, err := dumpTarget(context.Background(), s, t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t, err))
+		}
+		states = append(states, state)
+	}
+
+	err = writeDump(w, *format, states)
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// dumpTarget parses everything the sub collectors do from the filesystem
+// mounted at path.
+func dumpTarget(ctx context.Context, s *settings, path string) (*dumpState, error) {
+	state := &dumpState{Target: path}
+	errs := []error{}
+	addErr := func(what string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", what, err))
+			state.Errors = append(state.Errors, fmt.Sprintf("%s: %v", what, err))
+		}
+	}
+
+	var err error
+	state.FsUsage, err = readFsUsage(ctx, s, path)
+	addErr("fs usage", err)
+	if state.FsUsage != nil {
+		state.Uuid = state.FsUsage.FileSystem
+	}
+	if state.Uuid == "" {
+		state.Uuid, err = lookupUuid(s, path)
+		if err != nil {
+			addErr("uuid", err)
+			return state, errors.Join(errs...)
+		}
+	}
+
+	state.SysFs, err = sysfs.ParseSysFs(sysfs.Root(), state.Uuid)
+	addErr("sysfs", err)
+	state.TimeStats, err = sysfs.ParseSysFsTimeStats(sysfs.Root(), state.Uuid)
+	addErr("time_stats", err)
+	state.Devs, err = sysfs.ParseSysFsDevs(sysfs.Root(), state.Uuid)
+	addErr("devs", err)
+	state.BlockStats, err = sysfs.ParseSysFsDevBlockStats(sysfs.Root(), state.Uuid)
+	addErr("block_stats", err)
+	if s.showSuperBinPath != "" {
+		state.Superblock, err = readSuperblock(ctx, s, state.Uuid)
+		addErr("superblock", err)
+	}
+	state.Counters, err = sysfs.ParseSysFsCounters(sysfs.Root(), state.Uuid)
+	addErr("counters", err)
+	state.Options, err = sysfs.ParseSysFsOptions(sysfs.Root(), state.Uuid)
+	addErr("options", err)
+	state.FsErrors, err = sysfs.ParseSysFsErrors(sysfs.Root(), state.Uuid)
+	if errors.Is(err, fs.ErrNotExist) {
+		// 'errors' is missing on older kernels
+		err = nil
+	}
+	addErr("errors", err)
+	state.AllocDebug, err = sysfs.ParseSysFsAllocDebug(sysfs.Root(), state.Uuid)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	addErr("alloc_debug", err)
+	state.DevAllocDebug, err = sysfs.ParseSysFsDevAllocDebug(sysfs.Root(), state.Uuid)
+	addErr("dev_alloc_debug", err)
+
+	return state, errors.Join(errs...)
+}
+
+func writeDump(w io.Writer, format string, states []*dumpState) error {
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "yaml":
+		// go through JSON so that the keys are the same in both formats
+		var node yaml.Node
+		err = yaml.Unmarshal(b, &node)
+		if err != nil {
+			return err
+		}
+		resetYamlStyle(&node)
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		err = enc.Encode(&node)
+		if err != nil {
+			return err
+		}
+		return enc.Close()
+	case "table":
+		var v []interface{}
+		err = json.Unmarshal(b, &v)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for i, state := range v {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			writeDumpRows(tw, "", state)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("invalid format '%s'", format)
+}
+
+// resetYamlStyle drops the flow style JSON is decoded with, which would
+// print everything on one line.
+func resetYamlStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		resetYamlStyle(n)
+	}
+}
+
+// writeDumpRows writes a row of the dotted key and the value for every
+// scalar in v.
+func writeDumpRows(w io.Writer, key string, v interface{}) {
+	join := func(k string) string {
+		if key == "" {
+			return k
+		}
+		return key + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			writeDumpRows(w, join(k), v[k])
+		}
+	case []interface{}:
+		for i, item := range v {
+			writeDumpRows(w, join(strconv.Itoa(i)), item)
+		}
+	case nil:
+		fmt.Fprintf(w, "%s\t-\n", key)
+	case float64:
+		fmt.Fprintf(w, "%s\t%s\n", key, strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		fmt.Fprintf(w, "%s\t%v\n", key, v)
+	}
+}
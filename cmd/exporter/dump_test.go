@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRunDump(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "block", "stat"), "1 2 3 4 5 6 7 8 9 10 11\n")
+	writeTestFile(t, filepath.Join(fsDir, "internal", "alloc_debug"), "open buckets allocated  12\n")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "alloc_debug"), "reserves:\ncopygc           23\n")
+
+	// /tank is not mounted actually, so the usage can not be read
+	var out bytes.Buffer
+	err := runDump([]string{"--target", "/tank"}, &out)
+	assert.NotNil(err)
+
+	states := []dumpState{}
+	assert.Nil(json.Unmarshal(out.Bytes(), &states))
+	assert.Equal(1, len(states))
+	assert.Equal("/tank", states[0].Target)
+	assert.Equal(testUuid, states[0].Uuid)
+	assert.Nil(states[0].FsUsage)
+	assert.Equal("hdd.dev-0", states[0].Devs["dev-0"].Label)
+	assert.Equal(int64(100), states[0].Devs["dev-0"].NBuckets)
+	assert.Equal(int64(4), states[0].BlockStats["dev-0"].ReadTicks)
+	assert.Equal(int64(12), states[0].AllocDebug.Values["open buckets allocated"])
+	assert.Equal(int64(23), states[0].DevAllocDebug["dev-0"].Reserves["copygc"])
+	assert.NotEmpty(states[0].Errors)
+
+	out.Reset()
+	runDump([]string{"--target", "/tank", "--format", "yaml"}, &out)
+	yamlStates := []map[string]interface{}{}
+	assert.Nil(yaml.Unmarshal(out.Bytes(), &yamlStates))
+	assert.Equal(testUuid, yamlStates[0]["uuid"])
+	assert.Contains(out.String(), "\n  devs:\n    dev-0:\n")
+
+	out.Reset()
+	runDump([]string{"--target", "/tank", "--format", "table"}, &out)
+	assert.Contains(out.String(), "\ndevs.dev-0.nbuckets ")
+	assert.Contains(out.String(), "\nuuid                ")
+}
+
+func TestRunDumpEon(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "io_errors"), `IO errors since filesystem creation
+  read:    0
+  write:   0
+  checksum:0
+IO errors since 1 eon ago
+  read:    0
+  write:   0
+  checksum:0
+`)
+
+	var out bytes.Buffer
+	runDump([]string{"--target", "/tank"}, &out)
+	states := []dumpState{}
+	assert.Nil(json.Unmarshal(out.Bytes(), &states))
+	assert.Equal(1, len(states))
+	assert.InDelta(1.8446744073709552e10, states[0].Devs["dev-0"].IoErrors.RecentSeconds, 1)
+}
+
+func TestRunDumpSuperblock(t *testing.T) {
+	assert := assert.New(t)
+	fsDir := setupTestFs(t, "dev-0")
+	writeTestFile(t, filepath.Join(fsDir, "dev-0", "block", "uevent"), "MAJOR=8\nMINOR=48\nDEVNAME=sdd\n")
+	// a fake 'bcachefs' printing the superblock
+	bin := t.TempDir()
+	writeTestFile(t, filepath.Join(bin, "bcachefs"), "#!/bin/sh\nprintf 'Version:                                   1.25: extent_flags\\nClean:                                     1\\n'\n")
+	assert.Nil(os.Chmod(filepath.Join(bin, "bcachefs"), 0755))
+	t.Setenv("PATH", bin)
+
+	var out bytes.Buffer
+	runDump([]string{"--target", "/tank", "--superblock"}, &out)
+	states := []dumpState{}
+	assert.Nil(json.Unmarshal(out.Bytes(), &states))
+	assert.Equal(1, len(states))
+	assert.Equal(bcachefs.SuperblockVersion{Number: "1.25", Name: "extent_flags"}, states[0].Superblock.Version)
+	assert.True(states[0].Superblock.Clean)
+}
+
+func TestRunDumpInvalidArgs(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	assert.NotNil(runDump([]string{}, &out))
+	assert.NotNil(runDump([]string{"--target", "/tank", "--format", "xml"}, &out))
+	assert.NotNil(runDump([]string{"--target", "/tank", "--fsusage.source", "sysfs"}, &out))
+	assert.Equal(0, out.Len())
+}
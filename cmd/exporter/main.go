@@ -2,65 +2,265 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"time"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
 	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
 	"github.com/naoki9911/bcachefs_exporter/pkg/version"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	log "github.com/sirupsen/logrus"
 )
 
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// the capture being replayed and where it is extracted
 var (
-	targetPath = flag.String("target-path", "", "target path to export")
+	replayManifest *captureManifest
+	replayDir      string
+)
+
+var (
+	targetPaths        stringSliceFlag
+	webConfigFile      = flag.String("web.config.file", "", "path to the web configuration file enabling TLS or basic auth, in the exporter-toolkit format")
+	webListenAddresses stringSliceFlag
+	configFile         = flag.String("config.file", "", "path to the YAML configuration file, reloaded on SIGHUP")
+	discover           = flag.Bool("discover", false, "export every mounted bcachefs filesystem found in sysfs")
+	outputTextfile     = flag.String("output.textfile", "", "write the metrics to this file for the node_exporter textfile collector instead of serving them")
+	outputInterval     = flag.Duration("output.interval", 0, "how often --output.textfile is written, 0 to write it once and exit")
+	replay             = flag.String("replay", "", "serve metrics from a capture made by 'bcachefs_exporter capture' instead of the running system")
+	fsUsageSrc         = flag.String("fsusage.source", "ioctl", "how the fsusage collector reads the usage: 'ioctl' or 'tool' (runs 'bcachefs fs usage')")
 )
 
 func main() {
 	log.SetReportCaller(true)
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		err := runDump(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatalf("dump: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "capture" {
+		err := runCapture(os.Args[2:])
+		if err != nil {
+			log.Fatalf("capture: %v", err)
+		}
+		return
+	}
+
+	flag.Var(&targetPaths, "target-path", "target path to export (can be specified multiple times)")
+	flag.Var(&webListenAddresses, "web.listen-address", "address to serve metrics on (can be specified multiple times, default :9091)")
+	registerCollectorFlags(flag.CommandLine)
 	flag.Parse()
 
-	if *targetPath == "" {
-		log.Fatalf("--target-path is not specified")
-	}
 	log.Infof("bcachefs_exporter (version %s) started", version.Version)
-	bchBin, err := exec.LookPath("bcachefs")
+	if *replay != "" {
+		dir, err := os.MkdirTemp("", "bcachefs_exporter_replay")
+		if err != nil {
+			log.Fatalf("failed to create a directory for replay: %v", err)
+		}
+		// log.Fatal and signals exit without running the deferred call
+		removeDir := func() {
+			err := os.RemoveAll(dir)
+			if err != nil {
+				log.Warnf("Failed to remove %s: %v", dir, err)
+			}
+		}
+		defer removeDir()
+		log.RegisterExitHandler(removeDir)
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-term
+			removeDir()
+			log.Infof("Exiting on %v", sig)
+			// raise it again so that the exporter exits as killed by it
+			signal.Reset(sig)
+			p, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				err = p.Signal(sig)
+			}
+			if err != nil {
+				os.Exit(1)
+			}
+		}()
+		replayManifest, err = loadCapture(*replay, dir)
+		if err != nil {
+			log.Fatalf("failed to load %s: %v", *replay, err)
+		}
+		replayDir = dir
+		log.Infof("Replaying %s captured at %v", *replay, replayManifest.Time)
+	}
+	cfg, s, err := loadSettings(*configFile)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	err = web.Validate(*webConfigFile)
 	if err != nil {
-		log.Fatalf("failed to find command 'bcachefs': %v", err)
+		log.Fatalf("invalid web configuration: %v", err)
 	}
-	log.Infof("Target path: %s", *targetPath)
+	collector := newBcachefsCollector(s)
 
-	ticker := time.NewTicker(10 * time.Second)
-	run(bchBin, *targetPath)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		for {
-			<-ticker.C
-			run(bchBin, *targetPath)
+		current := cfg
+		for range hup {
+			newCfg, s, err := loadSettings(*configFile)
+			if err != nil {
+				log.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			for _, name := range restartSettings(current, newCfg) {
+				log.Warnf("%s is changed, which takes effect after restart", name)
+			}
+			current = newCfg
+			collector.update(s)
+			log.Infof("Reloaded configuration")
 		}
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":9091", nil)
+	if cfg.Output.Textfile != "" {
+		err = runTextfile(collector, cfg.Output.Textfile, cfg.Output.Interval)
+		if err != nil {
+			log.Fatalf("failed to write %s: %v", cfg.Output.Textfile, err)
+		}
+		return
+	}
+
+	http.Handle("/metrics", newMetricsHandler(collector))
+	// the web configuration file is read on every connection and request,
+	// so TLS certificates and users are updated without a reload
+	systemdSocket := false
+	log.Fatal(web.ListenAndServe(&http.Server{}, &web.FlagConfig{
+		WebListenAddresses: &cfg.ListenAddresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      webConfigFile,
+	}, kitLogger{}))
+}
+
+// loadSettings loads the configuration file, overrides it with the flags
+// specified on the command line and validates it.
+func loadSettings(path string) (*config, *settings, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "target-path":
+			cfg.Targets = targetPaths
+		case "web.listen-address":
+			cfg.ListenAddresses = webListenAddresses
+		case "discover":
+			cfg.Discover = *discover
+		case "output.textfile":
+			cfg.Output.Textfile = *outputTextfile
+		case "output.interval":
+			cfg.Output.Interval = *outputInterval
+		case "fsusage.source":
+			cfg.FsUsage.Source = *fsUsageSrc
+		}
+	})
+	applyCollectorFlags(flag.CommandLine, cfg.Collectors)
+	if replayManifest != nil {
+		// only the captured filesystems can be collected
+		cfg.Targets = []string{}
+		for _, t := range replayManifest.Targets {
+			cfg.Targets = append(cfg.Targets, t.Path)
+		}
+		cfg.Discover = false
+		cfg.FsUsage.Source = "ioctl"
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := newSettings(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if replayManifest != nil {
+		s.replayFsUsage = map[string]string{}
+		for _, t := range replayManifest.Targets {
+			if t.FsUsage != "" {
+				s.replayFsUsage[t.Path] = filepath.Join(replayDir, t.FsUsage)
+			}
+		}
+	}
+
+	for _, sc := range s.subCollectors {
+		log.Infof("Enabled collector: %s", sc.name)
+	}
+	for _, p := range cfg.Targets {
+		log.Infof("Target path: %s", p)
+	}
+	if cfg.Discover {
+		log.Infof("Discovering filesystems in %s", sysfs.SYSFS_PATH_PREFIX)
+	}
+	return cfg, s, nil
+}
+
+// discoverTargets returns the mountpoints of the mounted bcachefs filesystems
+// followed by the explicitly specified paths not among them.
+func discoverTargets(paths []string) ([]string, error) {
+	mounted, err := bcachefs.DiscoverFileSystems()
+	if err != nil {
+		return paths, fmt.Errorf("failed to discover filesystems: %v", err)
+	}
+	res := []string{}
+	for _, m := range mounted {
+		res = append(res, m.MountPoint)
+	}
+
+	return cleanTargets(append(res, paths...)), nil
+}
+
+// cleanTargets cleans every path and drops the duplicates, which would
+// export the same series twice.
+func cleanTargets(paths []string) []string {
+	res := []string{}
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		if !slices.Contains(res, p) {
+			res = append(res, p)
+		}
+	}
+	return res
 }
 
 var (
-	promBchSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_fs_usage_size",
-	},
+	promBchSize = prometheus.NewDesc(
+		"bcachefs_fs_usage_size_bytes",
+		"Capacity, used and online reserved space of the filesystem.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"type",
 		},
+		nil,
 	)
-	promBchReplicasUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_fs_usage_replicas_usage",
-	},
+	promBchReplicasUsage = prometheus.NewDesc(
+		"bcachefs_fs_usage_replicas_usage_bytes",
+		"Space used by each replicas entry.",
 		[]string{
 			"mountpoint",
 			"uuid",
@@ -69,39 +269,54 @@ var (
 			"durability",
 			"devices",
 		},
+		nil,
 	)
-	promBchCompression = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_fs_usage_compression",
-	},
+	promBchDegraded = prometheus.NewDesc(
+		"bcachefs_fs_degraded_bytes",
+		"Data by the durability desired and by how much it is degraded by offline devices.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"durability_desired",
+			"degraded_by",
+		},
+		nil,
+	)
+	promBchCompression = prometheus.NewDesc(
+		"bcachefs_fs_usage_compression_bytes",
+		"Compressed and uncompressed size and average extent size per compression type.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"compressionType",
 			"dataType",
 		},
+		nil,
 	)
-	promBchBtree = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_fs_usage_btree",
-	},
+	promBchBtree = prometheus.NewDesc(
+		"bcachefs_fs_usage_btree_bytes",
+		"Space used by each btree.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"dataType",
 		},
+		nil,
 	)
-	promBchReconcile = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_fs_usage_reconcile",
-	},
+	promBchReconcile = prometheus.NewDesc(
+		"bcachefs_fs_usage_reconcile_bytes",
+		"Data and metadata pending reconcile.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"type",
 			"dataType",
 		},
+		nil,
 	)
-	promBchDevice = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_fs_usage_device",
-	},
+	promBchDevice = prometheus.NewDesc(
+		"bcachefs_fs_usage_device_bytes",
+		"Data and fragmented space per device and data type.",
 		[]string{
 			"mountpoint",
 			"uuid",
@@ -110,59 +325,116 @@ var (
 			"type",
 			"dataType",
 		},
+		nil,
 	)
-	promBchSysFsBtreeWriteStat = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_btree_write_stats",
-	},
+	promBchDeviceBuckets = prometheus.NewDesc(
+		"bcachefs_fs_usage_device_buckets",
+		"Number of buckets per device and data type.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"label",
+			"device",
+			"type",
+		},
+		nil,
+	)
+	promBchSysFsBtreeWriteStatWrites = prometheus.NewDesc(
+		"bcachefs_sysfs_btree_write_stats_writes_total",
+		"Number of btree node writes per write type.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"type",
+		},
+		nil,
+	)
+	promBchSysFsBtreeWriteStatSize = prometheus.NewDesc(
+		"bcachefs_sysfs_btree_write_stats_average_size_bytes",
+		"Average size of btree node writes per write type.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"type",
-			"dataType",
 		},
+		nil,
 	)
-	promBchSysFsBtreeCacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_btree_cache_size",
-	},
+	promBchSysFsBtreeCacheSize = prometheus.NewDesc(
+		"bcachefs_sysfs_btree_cache_size_bytes",
+		"Size of the btree node cache.",
 		[]string{
 			"mountpoint",
 			"uuid",
 		},
+		nil,
 	)
-	promBchSysFsCompressionStat = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_compression_stats",
-	},
+	promBchSysFsCompressionStat = prometheus.NewDesc(
+		"bcachefs_sysfs_compression_stats_bytes",
+		"Compressed and uncompressed size and average extent size per compression type.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"compressionType",
 			"dataType",
 		},
+		nil,
 	)
-	promBchSysFsRebalanceStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_rebalance_status",
-	},
+	promBchSysFsRebalanceState = prometheus.NewDesc(
+		"bcachefs_sysfs_rebalance_state",
+		"1 for the state rebalance is in, 0 for the other states.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"state",
+		},
+		nil,
+	)
+	promBchSysFsRebalancePendingWork = prometheus.NewDesc(
+		"bcachefs_sysfs_rebalance_pending_work_bytes",
+		"Data waiting to be moved by rebalance.",
+		[]string{
+			"mountpoint",
+			"uuid",
+		},
+		nil,
+	)
+	promBchSysFsRebalanceStatusKeys = prometheus.NewDesc(
+		"bcachefs_sysfs_rebalance_status_keys",
+		"Keys moved and raced by a context of the running rebalance.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"context",
 			"dataType",
 			"item",
 		},
+		nil,
 	)
-	promBchSysFsTimeStat = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_time_stat",
-	},
+	promBchSysFsRebalanceStatusBytes = prometheus.NewDesc(
+		"bcachefs_sysfs_rebalance_status_bytes",
+		"Bytes seen, moved and raced by a context of the running rebalance.",
 		[]string{
 			"mountpoint",
 			"uuid",
-			"item",
+			"context",
 			"dataType",
+			"item",
+		},
+		nil,
+	)
+	promBchSysFsTimeStat = prometheus.NewDesc(
+		"bcachefs_sysfs_time_stat_seconds",
+		"Duration of events recorded by a time_stats entry.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"item",
 		},
+		nil,
 	)
-	promBchSysFsDevStat = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_dev_stat",
-	},
+	promBchSysFsDevStat = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_stat",
+		"Bucket counts and durability of a device.",
 		[]string{
 			"mountpoint",
 			"uuid",
@@ -171,10 +443,130 @@ var (
 			"devLabel",
 			"item",
 		},
+		nil,
 	)
-	promBchSysFsDevIoDone = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_dev_io_done",
-	},
+	promBchSysFsDevInfo = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_info",
+		"Member state, data types allowed and stored, and whether discard is enabled of a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"state",
+			"data_allowed",
+			"has_data",
+			"discard",
+		},
+		nil,
+	)
+	promBchSysFsDevState = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_state",
+		"1 for the member state a device is in, 0 for the other states.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"state",
+		},
+		nil,
+	)
+	promBchSysFsDevBlockInfo = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_block_info",
+		"Block device backing a device, labeled as node_exporter does.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"device",
+			"major",
+			"minor",
+		},
+		nil,
+	)
+	promBchSysFsDevBlockIos = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_block_ios_total",
+		"IOs completed by the block device backing a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"direction",
+		},
+		nil,
+	)
+	promBchSysFsDevBlockBytes = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_block_bytes_total",
+		"Bytes read, written and discarded by the block device backing a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"direction",
+		},
+		nil,
+	)
+	promBchSysFsDevBlockIoTime = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_block_io_time_seconds_total",
+		"Time spent on IOs by the block device backing a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"direction",
+		},
+		nil,
+	)
+	promBchSysFsDevBlockInFlight = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_block_in_flight",
+		"IOs in progress on the block device backing a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+		},
+		nil,
+	)
+	promBchSysFsDevBlockBusy = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_block_busy_seconds_total",
+		"Time the block device backing a device had IOs in progress.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+		},
+		nil,
+	)
+	promBchSysFsDevBucketSize = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_bucket_size_bytes",
+		"Bucket size of a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+		},
+		nil,
+	)
+	promBchSysFsDevIoDone = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_io_done_bytes_total",
+		"Bytes read from or written to a device per data type.",
 		[]string{
 			"mountpoint",
 			"uuid",
@@ -184,22 +576,37 @@ var (
 			"direction",
 			"item",
 		},
+		nil,
 	)
-	promBchSysFsDevIoErrors = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_dev_io_erros",
-	},
+	promBchSysFsDevIoErrors = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_io_errors_total",
+		"IO errors of a device since filesystem creation (window=\"creation\") or the last reset of the counters (window=\"recent\").",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"devName",
 			"devUuid",
 			"devLabel",
+			"window",
 			"item",
 		},
+		nil,
 	)
-	promBchSysFsDevIoLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_dev_io_latency",
-	},
+	promBchSysFsDevIoErrorsRecentWindow = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_io_errors_recent_window_seconds",
+		"Time since the recent IO error counters of a device were reset.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+		},
+		nil,
+	)
+	promBchSysFsDevIoLatency = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_io_latency_seconds",
+		"IO latency of a device.",
 		[]string{
 			"mountpoint",
 			"uuid",
@@ -207,180 +614,312 @@ var (
 			"devUuid",
 			"devLabel",
 			"direction",
+		},
+		nil,
+	)
+	promBchSysFsCounter = prometheus.NewDesc(
+		"bcachefs_sysfs_counter_total",
+		"Event counters since mount and since filesystem creation.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"item",
 			"dataType",
 		},
+		nil,
+	)
+	promBchFsOptions = prometheus.NewDesc(
+		"bcachefs_fs_options",
+		"Options of the filesystem whose value is a number or a size.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"option",
+		},
+		nil,
+	)
+	promBchFsOptionsInfo = prometheus.NewDesc(
+		"bcachefs_fs_options_info",
+		"Options of the filesystem whose value is a string like 'zstd:3'.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"option",
+			"value",
+		},
+		nil,
+	)
+	promBchFsDevOptions = prometheus.NewDesc(
+		"bcachefs_fs_dev_options",
+		"Options of a device whose value is a number or a size.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"option",
+		},
+		nil,
+	)
+	promBchFsDevOptionsInfo = prometheus.NewDesc(
+		"bcachefs_fs_dev_options_info",
+		"Options of a device whose value is a string.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"option",
+			"value",
+		},
+		nil,
+	)
+	promBchErrors = prometheus.NewDesc(
+		"bcachefs_errors_total",
+		"Errors the filesystem has seen since creation, by type of the error.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"error",
+		},
+		nil,
+	)
+	promBchErrorLastTimestamp = prometheus.NewDesc(
+		"bcachefs_error_last_timestamp_seconds",
+		"Time an error of the type last occurred.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"error",
+		},
+		nil,
+	)
+	promBchSysFsAllocDebug = prometheus.NewDesc(
+		"bcachefs_sysfs_alloc_debug",
+		"Numbers in internal/alloc_debug like capacity and open buckets allocated.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"item",
+		},
+		nil,
 	)
-	promBchSysFsCounter = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "bcachefs_sysfs_counter",
-	},
+	promBchSysFsAllocWaiting = prometheus.NewDesc(
+		"bcachefs_sysfs_alloc_waiting",
+		"1 if something waits on the waitlist in internal/alloc_debug like freelist_wait.",
 		[]string{
 			"mountpoint",
 			"uuid",
 			"item",
+		},
+		nil,
+	)
+	promBchSysFsDevAllocDebug = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_alloc_debug",
+		"Numbers in alloc_debug of a device like open buckets and buckets to invalidate.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"item",
+		},
+		nil,
+	)
+	promBchSysFsDevAllocWaiting = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_alloc_waiting",
+		"1 if something waits on the waitlist in alloc_debug of a device.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"item",
+		},
+		nil,
+	)
+	promBchSysFsDevAllocReserve = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_alloc_reserve_buckets",
+		"Buckets of a device reserved for allocations of the watermark.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"watermark",
+		},
+		nil,
+	)
+	promBchSysFsDevAllocBuckets = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_alloc_buckets",
+		"Buckets of a device by data type in alloc_debug.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"dataType",
+		},
+		nil,
+	)
+	promBchSysFsDevAllocBytes = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_alloc_bytes",
+		"Bytes of a device by data type in alloc_debug.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
 			"dataType",
 		},
+		nil,
+	)
+	promBchSysFsDevAllocFragmented = prometheus.NewDesc(
+		"bcachefs_sysfs_dev_alloc_fragmented_bytes",
+		"Fragmented bytes of a device by data type in alloc_debug.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"dataType",
+		},
+		nil,
+	)
+	promBchSbVersionInfo = prometheus.NewDesc(
+		"bcachefs_sb_version_info",
+		"On-disk version of the superblock, the version the last upgrade completed and the oldest version on disk.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"version",
+			"version_name",
+			"upgrade_complete",
+			"oldest_version",
+		},
+		nil,
+	)
+	promBchSbVersionUpgradePending = prometheus.NewDesc(
+		"bcachefs_sb_version_upgrade_pending",
+		"1 if the upgrade to the on-disk version is not complete.",
+		[]string{
+			"mountpoint",
+			"uuid",
+		},
+		nil,
+	)
+	promBchSbFeature = prometheus.NewDesc(
+		"bcachefs_sb_feature_info",
+		"Features and compat features in the superblock.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"feature",
+			"type",
+		},
+		nil,
+	)
+	promBchSbClean = prometheus.NewDesc(
+		"bcachefs_sb_clean",
+		"1 if the filesystem was cleanly unmounted.",
+		[]string{
+			"mountpoint",
+			"uuid",
+		},
+		nil,
+	)
+	promBchSbSequence = prometheus.NewDesc(
+		"bcachefs_sb_sequence",
+		"Sequence number of the superblock.",
+		[]string{
+			"mountpoint",
+			"uuid",
+		},
+		nil,
+	)
+	promBchSbMemberInfo = prometheus.NewDesc(
+		"bcachefs_sb_member_info",
+		"Member devices in the superblock.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+			"state",
+			"data_allowed",
+			"has_data",
+		},
+		nil,
+	)
+	promBchSbMemberLastMount = prometheus.NewDesc(
+		"bcachefs_sb_member_last_mount_timestamp_seconds",
+		"Time a member device was last mounted.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"devName",
+			"devUuid",
+			"devLabel",
+		},
+		nil,
+	)
+	promBchSbDiskGroupInfo = prometheus.NewDesc(
+		"bcachefs_sb_disk_group_info",
+		"Disk groups (labels) in the superblock.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"index",
+			"label",
+			"parent",
+		},
+		nil,
+	)
+	promBchSbReplicasInfo = prometheus.NewDesc(
+		"bcachefs_sb_replicas_info",
+		"Replicas entries in the superblock.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"dataType",
+			"requiredTotal",
+			"devices",
+		},
+		nil,
+	)
+	promBchSbErrors = prometheus.NewDesc(
+		"bcachefs_sb_errors_total",
+		"Errors recorded in the superblock by fsck and the filesystem.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"error",
+		},
+		nil,
+	)
+	promBchSbErrorLastTimestamp = prometheus.NewDesc(
+		"bcachefs_sb_error_last_timestamp_seconds",
+		"Time an error recorded in the superblock last occurred.",
+		[]string{
+			"mountpoint",
+			"uuid",
+			"error",
+		},
+		nil,
+	)
+	promBchScrapeCollectorSuccess = prometheus.NewDesc(
+		"bcachefs_scrape_collector_success",
+		"Whether a collector succeeded.",
+		[]string{
+			"mountpoint",
+			"collector",
+		},
+		nil,
+	)
+	promBchScrapeCollectorDuration = prometheus.NewDesc(
+		"bcachefs_scrape_collector_duration_seconds",
+		"Duration of a collector scrape.",
+		[]string{
+			"mountpoint",
+			"collector",
+		},
+		nil,
 	)
 )
-
-func run(bchBinPath, path string) {
-	results, err := exec.Command(bchBinPath, "fs", "usage", "-f", "replicas,btree,compression,rebalance_work,devices", path).Output()
-	if err != nil {
-		log.Fatalf("Failed to get usage: %v", err)
-	}
-
-	outputDir := filepath.Join("/tmp", "bcachefs_exporter")
-	err = os.MkdirAll(outputDir, 0755)
-	if err != nil {
-		log.Fatalf("Failed to create %s: %v", outputDir, err)
-	}
-	outputFilePath := filepath.Join(outputDir, "output.log")
-	outputFile, err := os.Create(outputFilePath)
-	if err != nil {
-		log.Fatalf("Failed to create %s: %v", outputFilePath, err)
-	}
-	defer outputFile.Close()
-	_, err = outputFile.Write(results)
-	if err != nil {
-		log.Fatalf("Failed to write output: %v", err)
-	}
-
-	fsUsage := bcachefs.ParseFsUsage(path, string(results))
-	sysFs, err := sysfs.ParseSysFs(fsUsage.FileSystem)
-	if err != nil {
-		log.Fatalf("Failed to parse sysfs: %v", err)
-	}
-	sysFsTimestats, err := sysfs.ParseSysFsTimeStats(fsUsage.FileSystem)
-	if err != nil {
-		log.Fatalf("Failed to parse sysfs time_stats: %v", err)
-	}
-
-	sysFsDevs, err := sysfs.ParseSysFsDevs(fsUsage.FileSystem)
-	if err != nil {
-		log.Fatalf("Failed to parse sysfs devs: %v", err)
-	}
-
-	sysFsCounters, err := sysfs.ParseSysFsCounters(fsUsage.FileSystem)
-	if err != nil {
-		log.Fatalf("Failed to parse sysfs counters: %v", err)
-	}
-
-	promBchSize.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, "capacity").Set(float64(fsUsage.Capacity))
-	promBchSize.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, "used").Set(float64(fsUsage.Used))
-	promBchSize.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, "online reserved").Set(float64(fsUsage.OnlineReserved))
-
-	for _, r := range fsUsage.Replicas {
-		promBchReplicasUsage.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, r.DataType, r.RequiredTotal, r.Durability, r.Devices).Set(float64(r.Size))
-	}
-
-	for _, c := range fsUsage.Compressions {
-		promBchCompression.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, c.CompressionType, "compressed").Set(float64(c.Comporessed))
-		promBchCompression.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, c.CompressionType, "uncompressed").Set(float64(c.Uncompressed))
-		promBchCompression.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, c.CompressionType, "average extent size").Set(float64(c.AverageExtentSize))
-	}
-	for _, b := range fsUsage.Btrees {
-		promBchBtree.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, b.DataType).Set(float64(b.Size))
-	}
-
-	for dataType, c := range fsUsage.Reconcile {
-		promBchReconcile.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, dataType, "data").Set(float64(c.Data))
-		promBchReconcile.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, dataType, "metadata").Set(float64(c.Metadata))
-	}
-
-	for _, dev := range fsUsage.Devices {
-		for _, ddev := range dev.Datas {
-			promBchDevice.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, dev.Label, dev.Device, ddev.DataType, "data").Set(float64(ddev.Size))
-			promBchDevice.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, dev.Label, dev.Device, ddev.DataType, "buckets").Set(float64(ddev.Buckets))
-			if ddev.HasFragmented {
-				promBchDevice.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, dev.Label, dev.Device, ddev.DataType, "fragmented").Set(float64(ddev.Fragmented))
-			}
-		}
-	}
-
-	if sysFs.BtreeWriteStat != nil {
-		for _, ws := range sysFs.BtreeWriteStat {
-			promBchSysFsBtreeWriteStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, ws.Stat, "nr").Set(float64(ws.NR))
-			promBchSysFsBtreeWriteStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, ws.Stat, "size").Set(float64(ws.Size))
-		}
-	}
-
-	promBchSysFsBtreeCacheSize.WithLabelValues(fsUsage.Path, fsUsage.FileSystem).Set(float64(sysFs.BtreeCacheSize))
-
-	if sysFs.CompressionStat != nil {
-		for _, cs := range sysFs.CompressionStat {
-			promBchSysFsCompressionStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, cs.CompressionType, "compressed").Set(float64(cs.Comporessed))
-			promBchSysFsCompressionStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, cs.CompressionType, "uncompressed").Set(float64(cs.Uncompressed))
-			promBchSysFsCompressionStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, cs.CompressionType, "average extent size").Set(float64(cs.AverageExtentSize))
-		}
-	}
-
-	if sysFs.RebalanceStatus != nil {
-		rs := sysFs.RebalanceStatus
-		promBchSysFsRebalanceStatus.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, rs.State, rs.DataType, "keys moved").Set(float64(rs.KeysMoved))
-		promBchSysFsRebalanceStatus.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, rs.State, rs.DataType, "keys raced").Set(float64(rs.KeysRaced))
-		promBchSysFsRebalanceStatus.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, rs.State, rs.DataType, "bytes seen").Set(float64(rs.BytesSeen))
-		promBchSysFsRebalanceStatus.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, rs.State, rs.DataType, "bytes moved").Set(float64(rs.BytesMoved))
-		promBchSysFsRebalanceStatus.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, rs.State, rs.DataType, "bytes raced").Set(float64(rs.BytesRaced))
-	}
-
-	for k, v := range sysFsTimestats {
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "count").Set(float64(v.Count))
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_min").Set(v.Duration.Min)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_max").Set(v.Duration.Max)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_total").Set(v.Duration.Total)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_mean").Set(v.Duration.Mean)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_stddev").Set(v.Duration.Stddev)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_recent_mean").Set(v.Duration.RecentMean)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "duration_recent_stddev").Set(v.Duration.RecentStddev)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "interval_min").Set(v.Interval.Min)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "interval_max").Set(v.Interval.Max)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "interval_mean").Set(v.Interval.Mean)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "interval_stddev").Set(v.Interval.Stddev)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "interval_recent_mean").Set(v.Interval.RecentMean)
-		promBchSysFsTimeStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "interval_recent_stddev").Set(v.Interval.RecentStddev)
-	}
-
-	for k, v := range sysFsDevs {
-		promBchSysFsDevStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "bucket_size").Set(float64(v.BucketSize))
-		promBchSysFsDevStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "nbuckets").Set(float64(v.NBuckets))
-		promBchSysFsDevStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "first_bucket").Set(float64(v.FirstBucket))
-		promBchSysFsDevStat.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "durability").Set(float64(v.Durability))
-		for rK, rV := range v.IoDone.Read {
-			promBchSysFsDevIoDone.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "read", rK).Set(float64(rV))
-		}
-		for wK, wV := range v.IoDone.Write {
-			promBchSysFsDevIoDone.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "write", wK).Set(float64(wV))
-		}
-		promBchSysFsDevIoErrors.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "read").Set(float64(v.IoErrors.Read))
-		promBchSysFsDevIoErrors.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "write").Set(float64(v.IoErrors.Write))
-		promBchSysFsDevIoErrors.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, "checksum").Set(float64(v.IoErrors.Checksum))
-
-		for i, ts := range []*sysfs.SysFsTimeStat{v.IoLatencyRead, v.IoLatencyWrite} {
-			dir := ""
-			if i == 0 {
-				dir = "read"
-			} else {
-				dir = "write"
-			}
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "count").Set(float64(ts.Count))
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_min").Set(ts.Duration.Min)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_max").Set(ts.Duration.Max)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_total").Set(ts.Duration.Total)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_mean").Set(ts.Duration.Mean)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_stddev").Set(ts.Duration.Stddev)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_recent_mean").Set(ts.Duration.RecentMean)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "duration_recent_stddev").Set(ts.Duration.RecentStddev)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "interval_min").Set(ts.Interval.Min)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "interval_max").Set(ts.Interval.Max)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "interval_mean").Set(ts.Interval.Mean)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "interval_stddev").Set(ts.Interval.Stddev)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "interval_recent_mean").Set(ts.Interval.RecentMean)
-			promBchSysFsDevIoLatency.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, v.Uuid, v.Label, dir, "interval_recent_stddev").Set(ts.Interval.RecentStddev)
-		}
-	}
-
-	for k, v := range sysFsCounters {
-		promBchSysFsCounter.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "mount").Set(float64(v.Mount))
-		promBchSysFsCounter.WithLabelValues(fsUsage.Path, fsUsage.FileSystem, k, "creation").Set(float64(v.Creation))
-	}
-	log.Infof("Parsed %s", fsUsage.FileSystem)
-}
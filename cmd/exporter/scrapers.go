@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs"
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// target is a filesystem being collected.
+type target struct {
+	path string
+	uuid string // filled by the fsusage collector
+}
+
+// subCollector collects one component of a filesystem.
+// A returned error marks the collection as failed, even if some metrics
+// were produced.
+type subCollector struct {
+	name           string
+	help           string
+	defaultEnabled bool
+	collect        func(ctx context.Context, s *settings, t *target, m *metrics) error
+}
+
+// subCollectors are run in order. fsusage comes first as it resolves the
+// uuid of the filesystem the others depend on.
+var subCollectors = []subCollector{
+	{name: "fsusage", help: "filesystem and device usage", defaultEnabled: true, collect: collectFsUsage},
+	{name: "btreewritestats", help: "sysfs btree_write_stats", defaultEnabled: true, collect: collectBtreeWriteStats},
+	{name: "btreecachesize", help: "sysfs btree_cache_size", defaultEnabled: true, collect: collectBtreeCacheSize},
+	{name: "compressionstats", help: "sysfs compression_stats", defaultEnabled: true, collect: collectCompressionStats},
+	{name: "rebalancestatus", help: "sysfs rebalance_status", defaultEnabled: true, collect: collectRebalanceStatus},
+	{name: "timestats", help: "sysfs time_stats", defaultEnabled: true, collect: collectTimeStats},
+	{name: "devs", help: "sysfs dev-*", defaultEnabled: true, collect: collectDevs},
+	{name: "counters", help: "sysfs counters", defaultEnabled: true, collect: collectCounters},
+	{name: "options", help: "sysfs options", defaultEnabled: true, collect: collectOptions},
+	{name: "errors", help: "sysfs errors", defaultEnabled: true, collect: collectErrors},
+	{name: "allocdebug", help: "sysfs internal/alloc_debug and alloc_debug of dev-*", defaultEnabled: true, collect: collectAllocDebug},
+	{name: "blockstat", help: "stat of the block devices backing dev-*", defaultEnabled: false, collect: collectBlockStat},
+	{name: "superblock", help: "superblock from 'bcachefs show-super'", defaultEnabled: false, collect: collectSuperblock},
+}
+
+type subCollectorFlags struct {
+	enable  *bool
+	disable *bool
+}
+
+var collectorFlags = map[string]subCollectorFlags{}
+
+// registerCollectorFlags adds --collector.<name> and --no-collector.<name>
+// for every sub collector.
+func registerCollectorFlags(fs *flag.FlagSet) {
+	for _, sc := range subCollectors {
+		collectorFlags[sc.name] = subCollectorFlags{
+			enable:  fs.Bool("collector."+sc.name, sc.defaultEnabled, fmt.Sprintf("enable the %s collector (%s)", sc.name, sc.help)),
+			disable: fs.Bool("no-collector."+sc.name, false, fmt.Sprintf("disable the %s collector", sc.name)),
+		}
+	}
+}
+
+// applyCollectorFlags overrides collectors with the --collector.<name> and
+// --no-collector.<name> flags set in fs. --no-collector.<name> takes
+// precedence over --collector.<name>.
+func applyCollectorFlags(fs *flag.FlagSet, collectors map[string]bool) {
+	fs.Visit(func(f *flag.Flag) {
+		if name, ok := strings.CutPrefix(f.Name, "collector."); ok {
+			collectors[name] = *collectorFlags[name].enable
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		if name, ok := strings.CutPrefix(f.Name, "no-collector."); ok && *collectorFlags[name].disable {
+			collectors[name] = false
+		}
+	})
+}
+
+// enabledSubCollectors returns the sub collectors enabled in collectors.
+// Those not in collectors are enabled by default.
+func enabledSubCollectors(collectors map[string]bool) []subCollector {
+	res := []subCollector{}
+	for _, sc := range subCollectors {
+		enabled, ok := collectors[sc.name]
+		if !ok {
+			enabled = sc.defaultEnabled
+		}
+		if enabled {
+			res = append(res, sc)
+		}
+	}
+	return res
+}
+
+// readFsUsageTool runs 'bcachefs fs usage' and parses its output.
+func readFsUsageTool(ctx context.Context, s *settings, path string) (*bcachefs.FsUsage, error) {
+	results, err := exec.CommandContext(ctx, s.bchBinPath, "fs", "usage", "-f", strings.Join(s.fsUsageFields, ","), path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %v", err)
+	}
+
+	if s.dumpDir != "" {
+		err = dumpOutput(s.dumpDir, path, results)
+		if err != nil {
+			log.Warnf("Failed to dump output: %v", err)
+		}
+	}
+
+	return bcachefs.ParseFsUsage(path, string(results))
+}
+
+// readFsUsageReplay parses the output of 'bcachefs fs usage' in a capture.
+func readFsUsageReplay(s *settings, path string) (*bcachefs.FsUsage, error) {
+	p, ok := s.replayFsUsage[path]
+	if !ok {
+		return nil, fmt.Errorf("usage of %s is not captured: %w", path, fs.ErrNotExist)
+	}
+	results, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return bcachefs.ParseFsUsage(path, string(results))
+}
+
+// readFsUsage reads the usage from the capture being replayed, with
+// bcachefs-tools if its path is set, or through the bcachefs ioctls.
+func readFsUsage(ctx context.Context, s *settings, path string) (*bcachefs.FsUsage, error) {
+	switch {
+	case s.replayFsUsage != nil:
+		return readFsUsageReplay(s, path)
+	case s.bchBinPath != "":
+		return readFsUsageTool(ctx, s, path)
+	default:
+		return bcachefs.ReadFsUsage(path)
+	}
+}
+
+func collectFsUsage(ctx context.Context, s *settings, t *target, m *metrics) error {
+	fsUsage, parseErr := readFsUsage(ctx, s, t.path)
+	if fsUsage == nil {
+		return parseErr
+	}
+	if fsUsage.FileSystem == "" {
+		return fmt.Errorf("failed to find the filesystem uuid: %w", parseErr)
+	}
+	t.uuid = fsUsage.FileSystem
+
+	m.gauge(promBchSize, float64(fsUsage.Capacity), t.path, t.uuid, "capacity")
+	m.gauge(promBchSize, float64(fsUsage.Used), t.path, t.uuid, "used")
+	m.gauge(promBchSize, float64(fsUsage.OnlineReserved), t.path, t.uuid, "online reserved")
+
+	for _, r := range fsUsage.Replicas {
+		m.gauge(promBchReplicasUsage, float64(r.Size), t.path, t.uuid, r.DataType, r.RequiredTotal, r.Durability, r.Devices)
+	}
+	for _, d := range fsUsage.Degraded {
+		m.gauge(promBchDegraded, float64(d.Size), t.path, t.uuid, d.DurabilityDesired, strconv.Itoa(d.DegradedBy))
+	}
+
+	for _, c := range fsUsage.Compressions {
+		m.gauge(promBchCompression, float64(c.Comporessed), t.path, t.uuid, c.CompressionType, "compressed")
+		m.gauge(promBchCompression, float64(c.Uncompressed), t.path, t.uuid, c.CompressionType, "uncompressed")
+		m.gauge(promBchCompression, float64(c.AverageExtentSize), t.path, t.uuid, c.CompressionType, "average extent size")
+	}
+	for _, b := range fsUsage.Btrees {
+		m.gauge(promBchBtree, float64(b.Size), t.path, t.uuid, b.DataType)
+	}
+
+	for dataType, c := range fsUsage.Reconcile {
+		m.gauge(promBchReconcile, float64(c.Data), t.path, t.uuid, dataType, "data")
+		m.gauge(promBchReconcile, float64(c.Metadata), t.path, t.uuid, dataType, "metadata")
+	}
+
+	for _, dev := range fsUsage.Devices {
+		for _, ddev := range dev.Datas {
+			m.gauge(promBchDevice, float64(ddev.Size), t.path, t.uuid, dev.Label, dev.Device, ddev.DataType, "data")
+			m.gauge(promBchDeviceBuckets, float64(ddev.Buckets), t.path, t.uuid, dev.Label, dev.Device, ddev.DataType)
+			if ddev.HasFragmented {
+				m.gauge(promBchDevice, float64(ddev.Fragmented), t.path, t.uuid, dev.Label, dev.Device, ddev.DataType, "fragmented")
+			}
+		}
+	}
+
+	return parseErr
+}
+
+func collectBtreeWriteStats(ctx context.Context, s *settings, t *target, m *metrics) error {
+	stats, err := sysfs.ParseSysFsBtreeWriteStats(sysfs.Root(), t.uuid)
+	if err != nil && stats == nil {
+		return err
+	}
+	for _, ws := range stats {
+		m.counter(promBchSysFsBtreeWriteStatWrites, float64(ws.NR), t.path, t.uuid, ws.Stat)
+		m.gauge(promBchSysFsBtreeWriteStatSize, float64(ws.Size), t.path, t.uuid, ws.Stat)
+	}
+
+	return err
+}
+
+func collectBtreeCacheSize(ctx context.Context, s *settings, t *target, m *metrics) error {
+	size, err := sysfs.ParseSysFsBtreeCacheSize(sysfs.Root(), t.uuid)
+	if err != nil {
+		return err
+	}
+	m.gauge(promBchSysFsBtreeCacheSize, float64(size), t.path, t.uuid)
+
+	return nil
+}
+
+func collectCompressionStats(ctx context.Context, s *settings, t *target, m *metrics) error {
+	stats, err := sysfs.ParseSysFsCompressionStats(sysfs.Root(), t.uuid)
+	if err != nil && stats == nil {
+		return err
+	}
+	for _, cs := range stats {
+		m.gauge(promBchSysFsCompressionStat, float64(cs.Comporessed), t.path, t.uuid, cs.CompressionType, "compressed")
+		m.gauge(promBchSysFsCompressionStat, float64(cs.Uncompressed), t.path, t.uuid, cs.CompressionType, "uncompressed")
+		m.gauge(promBchSysFsCompressionStat, float64(cs.AverageExtentSize), t.path, t.uuid, cs.CompressionType, "average extent size")
+	}
+
+	return err
+}
+
+func collectRebalanceStatus(ctx context.Context, s *settings, t *target, m *metrics) error {
+	rs, err := sysfs.ParseSysFsRebalanceStatus(sysfs.Root(), t.uuid)
+	if err != nil && rs == nil {
+		return err
+	}
+	states := sysfs.SysFsRebalanceStates
+	if rs.State != "" && !slices.Contains(states, rs.State) {
+		states = append(slices.Clone(states), rs.State)
+	}
+	for _, state := range states {
+		value := 0.0
+		if state == rs.State {
+			value = 1
+		}
+		m.gauge(promBchSysFsRebalanceState, value, t.path, t.uuid, state)
+	}
+	m.gauge(promBchSysFsRebalancePendingWork, float64(rs.PendingWork), t.path, t.uuid)
+	for _, c := range rs.Contexts {
+		m.gauge(promBchSysFsRebalanceStatusKeys, float64(c.KeysMoved), t.path, t.uuid, c.Name, c.DataType, "moved")
+		m.gauge(promBchSysFsRebalanceStatusKeys, float64(c.KeysRaced), t.path, t.uuid, c.Name, c.DataType, "raced")
+		m.gauge(promBchSysFsRebalanceStatusBytes, float64(c.BytesSeen), t.path, t.uuid, c.Name, c.DataType, "seen")
+		m.gauge(promBchSysFsRebalanceStatusBytes, float64(c.BytesMoved), t.path, t.uuid, c.Name, c.DataType, "moved")
+		m.gauge(promBchSysFsRebalanceStatusBytes, float64(c.BytesRaced), t.path, t.uuid, c.Name, c.DataType, "raced")
+	}
+
+	return err
+}
+
+func collectTimeStats(ctx context.Context, s *settings, t *target, m *metrics) error {
+	timeStats, err := sysfs.ParseSysFsTimeStats(sysfs.Root(), t.uuid)
+	for k, v := range timeStats {
+		m.timeStat(promBchSysFsTimeStat, &v, t.path, t.uuid, k)
+	}
+
+	return err
+}
+
+func collectDevs(ctx context.Context, s *settings, t *target, m *metrics) error {
+	devs, err := sysfs.ParseSysFsDevs(sysfs.Root(), t.uuid)
+	for k, v := range devs {
+		m.gauge(promBchSysFsDevBucketSize, float64(v.BucketSize), t.path, t.uuid, k, v.Uuid, v.Label)
+		m.gauge(promBchSysFsDevStat, float64(v.NBuckets), t.path, t.uuid, k, v.Uuid, v.Label, "nbuckets")
+		m.gauge(promBchSysFsDevStat, float64(v.FirstBucket), t.path, t.uuid, k, v.Uuid, v.Label, "first_bucket")
+		m.gauge(promBchSysFsDevStat, float64(v.Durability), t.path, t.uuid, k, v.Uuid, v.Label, "durability")
+		if v.Block != nil {
+			m.gauge(promBchSysFsDevBlockInfo, 1, t.path, t.uuid, k, v.Uuid, v.Label,
+				v.Block.Name, strconv.FormatInt(v.Block.Major, 10), strconv.FormatInt(v.Block.Minor, 10))
+		}
+		if v.State != "" {
+			m.gauge(promBchSysFsDevInfo, 1, t.path, t.uuid, k, v.Uuid, v.Label,
+				v.State, strings.Join(v.DataAllowed, ","), strings.Join(v.HasData, ","), strconv.FormatBool(v.Discard))
+			for _, state := range v.States {
+				value := 0.0
+				if state == v.State {
+					value = 1
+				}
+				m.gauge(promBchSysFsDevState, value, t.path, t.uuid, k, v.Uuid, v.Label, state)
+			}
+		}
+		for oK, oV := range v.Options {
+			if oV.Number != nil {
+				m.gauge(promBchFsDevOptions, float64(*oV.Number), t.path, t.uuid, k, v.Uuid, v.Label, oK)
+			} else {
+				m.gauge(promBchFsDevOptionsInfo, 1, t.path, t.uuid, k, v.Uuid, v.Label, oK, oV.Value)
+			}
+		}
+		if v.IoDone != nil {
+			for rK, rV := range v.IoDone.Read {
+				m.counter(promBchSysFsDevIoDone, float64(rV), t.path, t.uuid, k, v.Uuid, v.Label, "read", rK)
+			}
+			for wK, wV := range v.IoDone.Write {
+				m.counter(promBchSysFsDevIoDone, float64(wV), t.path, t.uuid, k, v.Uuid, v.Label, "write", wK)
+			}
+		}
+		if v.IoErrors != nil {
+			windows := map[string]*sysfs.SysFsDevIoErrorCounts{
+				"creation": &v.IoErrors.SinceCreation,
+				"recent":   v.IoErrors.Recent,
+			}
+			for window, c := range windows {
+				if c == nil {
+					continue
+				}
+				m.counter(promBchSysFsDevIoErrors, float64(c.Read), t.path, t.uuid, k, v.Uuid, v.Label, window, "read")
+				m.counter(promBchSysFsDevIoErrors, float64(c.Write), t.path, t.uuid, k, v.Uuid, v.Label, window, "write")
+				m.counter(promBchSysFsDevIoErrors, float64(c.Checksum), t.path, t.uuid, k, v.Uuid, v.Label, window, "checksum")
+			}
+			if v.IoErrors.Recent != nil {
+				m.gauge(promBchSysFsDevIoErrorsRecentWindow, v.IoErrors.RecentSeconds, t.path, t.uuid, k, v.Uuid, v.Label)
+			}
+		}
+
+		for i, ts := range []*sysfs.SysFsTimeStat{v.IoLatencyRead, v.IoLatencyWrite} {
+			if ts == nil {
+				continue
+			}
+			dir := ""
+			if i == 0 {
+				dir = "read"
+			} else {
+				dir = "write"
+			}
+			m.timeStat(promBchSysFsDevIoLatency, ts, t.path, t.uuid, k, v.Uuid, v.Label, dir)
+		}
+	}
+
+	return err
+}
+
+func collectBlockStat(ctx context.Context, s *settings, t *target, m *metrics) error {
+	stats, err := sysfs.ParseSysFsDevBlockStats(sysfs.Root(), t.uuid)
+	for k, v := range stats {
+		m.counter(promBchSysFsDevBlockIos, float64(v.ReadIos), t.path, t.uuid, k, v.Uuid, v.Label, "read")
+		m.counter(promBchSysFsDevBlockIos, float64(v.WriteIos), t.path, t.uuid, k, v.Uuid, v.Label, "write")
+		m.counter(promBchSysFsDevBlockIos, float64(v.DiscardIos), t.path, t.uuid, k, v.Uuid, v.Label, "discard")
+		m.counter(promBchSysFsDevBlockIos, float64(v.FlushIos), t.path, t.uuid, k, v.Uuid, v.Label, "flush")
+		// sectors are always 512 bytes in the stat
+		m.counter(promBchSysFsDevBlockBytes, float64(v.ReadSectors*512), t.path, t.uuid, k, v.Uuid, v.Label, "read")
+		m.counter(promBchSysFsDevBlockBytes, float64(v.WriteSectors*512), t.path, t.uuid, k, v.Uuid, v.Label, "write")
+		m.counter(promBchSysFsDevBlockBytes, float64(v.DiscardSectors*512), t.path, t.uuid, k, v.Uuid, v.Label, "discard")
+		m.counter(promBchSysFsDevBlockIoTime, float64(v.ReadTicks)/1000, t.path, t.uuid, k, v.Uuid, v.Label, "read")
+		m.counter(promBchSysFsDevBlockIoTime, float64(v.WriteTicks)/1000, t.path, t.uuid, k, v.Uuid, v.Label, "write")
+		m.counter(promBchSysFsDevBlockIoTime, float64(v.DiscardTicks)/1000, t.path, t.uuid, k, v.Uuid, v.Label, "discard")
+		m.counter(promBchSysFsDevBlockIoTime, float64(v.FlushTicks)/1000, t.path, t.uuid, k, v.Uuid, v.Label, "flush")
+		m.gauge(promBchSysFsDevBlockInFlight, float64(v.InFlight), t.path, t.uuid, k, v.Uuid, v.Label)
+		m.counter(promBchSysFsDevBlockBusy, float64(v.IoTicks)/1000, t.path, t.uuid, k, v.Uuid, v.Label)
+	}
+
+	return err
+}
+
+func collectCounters(ctx context.Context, s *settings, t *target, m *metrics) error {
+	counters, err := sysfs.ParseSysFsCounters(sysfs.Root(), t.uuid)
+	for k, v := range counters {
+		m.counter(promBchSysFsCounter, float64(v.Mount), t.path, t.uuid, k, "mount")
+		m.counter(promBchSysFsCounter, float64(v.Creation), t.path, t.uuid, k, "creation")
+	}
+
+	return err
+}
+
+func collectOptions(ctx context.Context, s *settings, t *target, m *metrics) error {
+	options, err := sysfs.ParseSysFsOptions(sysfs.Root(), t.uuid)
+	for k, v := range options {
+		if v.Number != nil {
+			m.gauge(promBchFsOptions, float64(*v.Number), t.path, t.uuid, k)
+		} else {
+			m.gauge(promBchFsOptionsInfo, 1, t.path, t.uuid, k, v.Value)
+		}
+	}
+
+	return err
+}
+
+func collectErrors(ctx context.Context, s *settings, t *target, m *metrics) error {
+	errs, err := sysfs.ParseSysFsErrors(sysfs.Root(), t.uuid)
+	for k, v := range errs {
+		m.counter(promBchErrors, float64(v.Count), t.path, t.uuid, k)
+		m.gauge(promBchErrorLastTimestamp, float64(v.LastTime.Unix()), t.path, t.uuid, k)
+	}
+
+	return err
+}
+
+// allocDebugItem turns an item like 'open buckets allocated' into a label value
+func allocDebugItem(item string) string {
+	return strings.ReplaceAll(item, " ", "_")
+}
+
+func collectAllocDebug(ctx context.Context, s *settings, t *target, m *metrics) error {
+	errs := []error{}
+	d, err := sysfs.ParseSysFsAllocDebug(sysfs.Root(), t.uuid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("internal/alloc_debug: %w", err))
+	}
+	if d != nil {
+		for k, v := range d.Values {
+			m.gauge(promBchSysFsAllocDebug, float64(v), t.path, t.uuid, allocDebugItem(k))
+		}
+		for k, v := range d.Waits {
+			waiting := 0.0
+			if v == "waiting" {
+				waiting = 1
+			}
+			m.gauge(promBchSysFsAllocWaiting, waiting, t.path, t.uuid, allocDebugItem(k))
+		}
+	}
+
+	devs, err := sysfs.ParseSysFsDevAllocDebug(sysfs.Root(), t.uuid)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for k, v := range devs {
+		for iK, iV := range v.Values {
+			m.gauge(promBchSysFsDevAllocDebug, float64(iV), t.path, t.uuid, k, allocDebugItem(iK))
+		}
+		for wK, wV := range v.Waits {
+			waiting := 0.0
+			if wV == "waiting" {
+				waiting = 1
+			}
+			m.gauge(promBchSysFsDevAllocWaiting, waiting, t.path, t.uuid, k, allocDebugItem(wK))
+		}
+		for rK, rV := range v.Reserves {
+			m.gauge(promBchSysFsDevAllocReserve, float64(rV), t.path, t.uuid, k, rK)
+		}
+		for uK, uV := range v.Usage {
+			m.gauge(promBchSysFsDevAllocBuckets, float64(uV.Buckets), t.path, t.uuid, k, uK)
+			m.gauge(promBchSysFsDevAllocBytes, float64(uV.Sectors*512), t.path, t.uuid, k, uK)
+			m.gauge(promBchSysFsDevAllocFragmented, float64(uV.Fragmented*512), t.path, t.uuid, k, uK)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// readSuperblock runs 'bcachefs show-super' on the online member device
+// with the lowest index, which has the superblock of the filesystem.
+func readSuperblock(ctx context.Context, s *settings, uuid string) (*bcachefs.Superblock, error) {
+	members, err := sysfs.ParseSysFsDevMembers(sysfs.Root(), uuid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %v", err)
+	}
+	dev := ""
+	for _, idx := range slices.Sorted(maps.Keys(members)) {
+		if members[idx].BlockDev != "" {
+			dev = "/dev/" + members[idx].BlockDev
+			break
+		}
+	}
+	if dev == "" {
+		return nil, fmt.Errorf("no device is online")
+	}
+
+	results, err := exec.CommandContext(ctx, s.showSuperBinPath, "show-super", "-f", "all", dev).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to show superblock of %s: %v", dev, err)
+	}
+	return bcachefs.ParseShowSuper(string(results))
+}
+
+func collectSuperblock(ctx context.Context, s *settings, t *target, m *metrics) error {
+	if s.replayFsUsage != nil {
+		return fmt.Errorf("superblock is not captured: %w", fs.ErrNotExist)
+	}
+	sb, err := readSuperblock(ctx, s, t.uuid)
+	if sb == nil {
+		return err
+	}
+
+	m.gauge(promBchSbVersionInfo, 1, t.path, t.uuid,
+		sb.Version.Number, sb.Version.Name, sb.VersionUpgradeComplete.Number, sb.OldestVersionOnDisk.Number)
+	upgradePending := 0.0
+	if sb.Version.Number != sb.VersionUpgradeComplete.Number {
+		upgradePending = 1
+	}
+	m.gauge(promBchSbVersionUpgradePending, upgradePending, t.path, t.uuid)
+	for _, f := range sb.Features {
+		m.gauge(promBchSbFeature, 1, t.path, t.uuid, f, "incompat")
+	}
+	for _, f := range sb.CompatFeatures {
+		m.gauge(promBchSbFeature, 1, t.path, t.uuid, f, "compat")
+	}
+	clean := 0.0
+	if sb.Clean {
+		clean = 1
+	}
+	m.gauge(promBchSbClean, clean, t.path, t.uuid)
+	m.gauge(promBchSbSequence, float64(sb.Sequence), t.path, t.uuid)
+
+	for _, mem := range sb.Members {
+		devName := "dev-" + strconv.Itoa(mem.Index)
+		m.gauge(promBchSbMemberInfo, 1, t.path, t.uuid, devName, mem.Uuid, mem.Label,
+			mem.State, strings.Join(mem.DataAllowed, ","), strings.Join(mem.HasData, ","))
+		if !mem.LastMount.IsZero() {
+			m.gauge(promBchSbMemberLastMount, float64(mem.LastMount.Unix()), t.path, t.uuid, devName, mem.Uuid, mem.Label)
+		}
+	}
+	for _, g := range sb.DiskGroups {
+		if !g.Deleted {
+			m.gauge(promBchSbDiskGroupInfo, 1, t.path, t.uuid, strconv.Itoa(g.Index), g.Label, strconv.Itoa(g.Parent))
+		}
+	}
+	for _, r := range sb.Replicas {
+		m.gauge(promBchSbReplicasInfo, 1, t.path, t.uuid, r.DataType, r.RequiredTotal, r.Devices)
+	}
+	for _, e := range sb.Errors {
+		m.counter(promBchSbErrors, float64(e.Count), t.path, t.uuid, e.Type)
+		if !e.LastTime.IsZero() {
+			m.gauge(promBchSbErrorLastTimestamp, float64(e.LastTime.Unix()), t.path, t.uuid, e.Type)
+		}
+	}
+
+	return err
+}
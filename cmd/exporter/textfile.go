@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// writeTextfile collects the metrics once and writes them to path for the
+// textfile collector of node_exporter. The file is replaced atomically, so
+// node_exporter never reads a partially written one.
+func writeTextfile(c *bcachefsCollector, path string) error {
+	reg := prometheus.NewRegistry()
+	err := prometheus.WrapRegistererWith(c.currentSettings().labels, reg).Register(c)
+	if err != nil {
+		return err
+	}
+	return prometheus.WriteToTextfile(path, reg)
+}
+
+// runTextfile writes the metrics to path every interval, or only once if
+// interval is 0.
+func runTextfile(c *bcachefsCollector, path string, interval time.Duration) error {
+	for {
+		begin := time.Now()
+		err := writeTextfile(c, path)
+		if interval == 0 {
+			return err
+		}
+		if err != nil {
+			log.Errorf("Failed to write %s: %v", path, err)
+		} else {
+			log.Debugf("Wrote %s in %v", path, time.Since(begin))
+		}
+		time.Sleep(time.Until(begin.Add(interval)))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	assert := assert.New(t)
+	setupTestFs(t, "dev-0")
+	devs := []subCollector{}
+	for _, sc := range subCollectors {
+		if sc.name == "devs" {
+			devs = append(devs, sc)
+		}
+	}
+	c := newBcachefsCollector(&settings{
+		labels: prometheus.Labels{"host": "nas"},
+		targets: func() ([]string, error) {
+			return []string{"/tank"}, nil
+		},
+		subCollectors: devs,
+	})
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, "bcachefs.prom")
+	writeTestFile(t, p, "stale\n")
+	assert.Nil(runTextfile(c, p, 0))
+
+	b, err := os.ReadFile(p)
+	assert.Nil(err)
+	assert.NotContains(string(b), "stale")
+	assert.Contains(string(b), "# TYPE bcachefs_sysfs_dev_bucket_size_bytes gauge\n")
+	assert.Contains(string(b), `bcachefs_sysfs_dev_bucket_size_bytes{devLabel="hdd.dev-0",devName="dev-0",devUuid="uuid-dev-0",host="nas",mountpoint="/tank",uuid="`+testUuid+`"} 512000`)
+	// no temporary file is left
+	items, err := os.ReadDir(dir)
+	assert.Nil(err)
+	assert.Equal(1, len(items))
+
+	assert.NotNil(writeTextfile(c, filepath.Join(dir, "missing", "bcachefs.prom")))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kitLogger passes the logs of exporter-toolkit, which are go-kit
+// key-value pairs, to logrus.
+type kitLogger struct{}
+
+func (kitLogger) Log(keyvals ...interface{}) error {
+	fields := log.Fields{}
+	msg := ""
+	level := log.InfoLevel
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		k := fmt.Sprint(keyvals[i])
+		v := keyvals[i+1]
+		switch k {
+		case "msg":
+			msg = fmt.Sprint(v)
+		case "level":
+			l, err := log.ParseLevel(fmt.Sprint(v))
+			if err == nil {
+				level = l
+			}
+		default:
+			fields[k] = v
+		}
+	}
+	log.WithFields(fields).Log(level, msg)
+	return nil
+}
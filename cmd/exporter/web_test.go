@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeWithBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	webConfig := filepath.Join(t.TempDir(), "web.yaml")
+	// the password is 'secret'
+	writeTestFile(t, webConfig, `
+basic_auth_users:
+  prometheus: $2a$04$i8Ld1pl9rEXt8SLFz5HJZOsJ0wnVHDdyyqxh7kdbXDZyKvTqL4slS
+`)
+	assert.Nil(web.Validate(webConfig))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go web.Serve(l, server, &web.FlagConfig{WebConfigFile: &webConfig}, kitLogger{})
+	defer server.Close()
+
+	url := fmt.Sprintf("http://%s/metrics", l.Addr())
+	for _, c := range []struct {
+		user     string
+		password string
+		status   int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"prometheus", "secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		assert.Nil(err)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nil(err) {
+			resp.Body.Close()
+			assert.Equal(c.status, resp.StatusCode, c.user+":"+c.password)
+		}
+	}
+}
+
+func TestInvalidWebConfig(t *testing.T) {
+	webConfig := filepath.Join(t.TempDir(), "web.yaml")
+	writeTestFile(t, webConfig, `
+tls_server_config:
+  cert_file: missing.crt
+`)
+	assert.NotNil(t, web.Validate(webConfig))
+}
@@ -0,0 +1,154 @@
+package bcachefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	log "github.com/sirupsen/logrus"
+)
+
+var MOUNTINFO_PATH = "/proc/self/mountinfo"
+
+type MountInfo struct {
+	MajorMinor string
+	Root       string
+	MountPoint string
+	FsType     string
+	Source     string
+}
+
+type MountedFileSystem struct {
+	Uuid       string
+	MountPoint string
+}
+
+// DiscoverFileSystems returns the bcachefs filesystems found in sysfs
+// together with the place they are mounted at.
+// Filesystems which are not mounted are omitted.
+func DiscoverFileSystems() ([]MountedFileSystem, error) {
+	data, err := os.ReadFile(MOUNTINFO_PATH)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := parseMountInfo(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s': %v", MOUNTINFO_PATH, err)
+	}
+
+	root := sysfs.Root()
+	uuids, err := sysfs.ListFileSystems(root)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []MountedFileSystem{}
+	for _, uuid := range uuids {
+		blocks, err := sysfs.ParseSysFsDevBlockNumbers(root, uuid)
+		if err != nil {
+			log.Warnf("failed to get block devices of %s: %v", uuid, err)
+			continue
+		}
+		mountPoint := findMountPoint(mounts, uuid, blocks)
+		if mountPoint == "" {
+			log.Debugf("%s is not mounted", uuid)
+			continue
+		}
+		res = append(res, MountedFileSystem{
+			Uuid:       uuid,
+			MountPoint: mountPoint,
+		})
+	}
+
+	return res, nil
+}
+
+// LookupFileSystem returns the bcachefs filesystem mounted at mountPoint.
+func LookupFileSystem(mountPoint string) (*MountedFileSystem, error) {
+	mounted, err := DiscoverFileSystems()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounted {
+		if m.MountPoint == filepath.Clean(mountPoint) {
+			return &m, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no bcachefs filesystem is mounted at '%s'", mountPoint)
+}
+
+// findMountPoint returns the first bcachefs mount of the filesystem.
+// bcachefs reports the device number of one of its members in mountinfo,
+// so mounts are matched against the members' block devices.
+func findMountPoint(mounts []MountInfo, uuid string, blocks map[string]string) string {
+	for _, m := range mounts {
+		if m.FsType != "bcachefs" || m.Root != "/" {
+			continue
+		}
+		if m.Source == "UUID="+uuid {
+			return m.MountPoint
+		}
+		for _, b := range blocks {
+			if m.MajorMinor == b {
+				return m.MountPoint
+			}
+		}
+	}
+
+	return ""
+}
+
+// parseMountInfo parses the format described in proc(5).
+func parseMountInfo(s string) ([]MountInfo, error) {
+	res := []MountInfo{}
+	for _, line := range strings.Split(s, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		sepIdx := -1
+		for i, f := range fields {
+			if f == "-" {
+				sepIdx = i
+				break
+			}
+		}
+		if sepIdx < 6 || len(fields) < sepIdx+3 {
+			return nil, fmt.Errorf("unexpected line '%s'", line)
+		}
+		res = append(res, MountInfo{
+			MajorMinor: fields[2],
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			FsType:     fields[sepIdx+1],
+			Source:     unescapeMountInfo(fields[sepIdx+2]),
+		})
+	}
+
+	return res, nil
+}
+
+// unescapeMountInfo decodes the octal escapes (e.g. '\040' for a space)
+// the kernel uses in mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return '0' <= c && c <= '7'
+}
@@ -0,0 +1,50 @@
+package bcachefs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	assert := assert.New(t)
+	input := `23 28 0:22 / /proc rw,relatime - proc proc rw
+28 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+95 28 8:48 / /tank rw,relatime shared:45 - bcachefs /dev/sdd:/dev/sde:/dev/nvme1n1 rw,compression=zstd
+96 28 8:64 /sub /mnt/my\040pool rw,relatime shared:46 master:2 - bcachefs /dev/sdf rw
+`
+	mounts, err := parseMountInfo(input)
+	assert.Nil(err)
+	assert.Equal(4, len(mounts))
+	assert.Equal(MountInfo{
+		MajorMinor: "8:48",
+		Root:       "/",
+		MountPoint: "/tank",
+		FsType:     "bcachefs",
+		Source:     "/dev/sdd:/dev/sde:/dev/nvme1n1",
+	}, mounts[2])
+	assert.Equal("/sub", mounts[3].Root)
+	assert.Equal("/mnt/my pool", mounts[3].MountPoint)
+	assert.Equal("bcachefs", mounts[3].FsType)
+
+	_, err = parseMountInfo("23 28 0:22 / /proc rw,relatime proc proc rw\n")
+	assert.NotNil(err)
+}
+
+func TestFindMountPoint(t *testing.T) {
+	assert := assert.New(t)
+	mounts := []MountInfo{
+		{MajorMinor: "8:48", Root: "/", MountPoint: "/srv", FsType: "ext4", Source: "/dev/sdd"},
+		{MajorMinor: "8:64", Root: "/sub", MountPoint: "/bind", FsType: "bcachefs", Source: "/dev/sde"},
+		{MajorMinor: "8:64", Root: "/", MountPoint: "/tank", FsType: "bcachefs", Source: "/dev/sdd:/dev/sde"},
+		{MajorMinor: "0:50", Root: "/", MountPoint: "/pool", FsType: "bcachefs", Source: "UUID=a9da1e6e-d4e5-4717-a520-408c8af4b084"},
+	}
+
+	blocks := map[string]string{
+		"dev-0": "8:48",
+		"dev-1": "8:64",
+	}
+	assert.Equal("/tank", findMountPoint(mounts, "0c7ff0a6-8b0d-4b3b-9e53-2cf5e8b3f0a1", blocks))
+	assert.Equal("/pool", findMountPoint(mounts, "a9da1e6e-d4e5-4717-a520-408c8af4b084", map[string]string{}))
+	assert.Equal("", findMountPoint(mounts, "0c7ff0a6-8b0d-4b3b-9e53-2cf5e8b3f0a1", map[string]string{"dev-0": "8:80"}))
+}
@@ -0,0 +1,441 @@
+package bcachefs
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Definitions from the kernel's fs/bcachefs/bcachefs_ioctl.h and
+// disk_accounting_format.h. All structures are little endian on the
+// architectures bcachefs supports.
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+
+	bchIoctlMagic = 0xbc
+
+	// BCH_BY_INDEX: 'dev' of bch_ioctl_dev_usage is an index, not a path
+	bchByIndex = 1 << 0
+
+	bchReplicasMax = 4
+
+	sectorShift = 9
+
+	fsUsageHeaderSize         = 64
+	queryAccountingHeaderSize = 32
+	devUsageSize              = 280
+	devUsageV2HeaderSize      = 32
+	devUsageTypeSize          = 24
+	devUsageV1DataTypes       = 10
+	queryUuidSize             = 16
+
+	bkeySize = 40
+	// offset of struct bpos in struct bkey, which holds disk_accounting_pos
+	bkeyPosOffset = 20
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | bchIoctlMagic<<8 | nr
+}
+
+var (
+	bchIoctlQueryUuid       = ioc(iocRead, 1, queryUuidSize)
+	bchIoctlFsUsage         = ioc(iocRead|iocWrite, 11, fsUsageHeaderSize)
+	bchIoctlDevUsage        = ioc(iocRead|iocWrite, 11, devUsageSize)
+	bchIoctlDevUsageV2      = ioc(iocRead|iocWrite, 18, devUsageV2HeaderSize)
+	bchIoctlQueryAccounting = ioc(iocWrite, 21, queryAccountingHeaderSize)
+)
+
+// enum bch_data_type
+var bchDataTypes = []string{
+	"free",
+	"sb",
+	"journal",
+	"btree",
+	"user",
+	"cached",
+	"parity",
+	"stripe",
+	"need_gc_gens",
+	"need_discard",
+	"unstriped",
+}
+
+// enum bch_compression_type
+var bchCompressionTypes = []string{
+	"none",
+	"lz4_old",
+	"gzip",
+	"lz4",
+	"zstd",
+	"incompressible",
+}
+
+// enum bch_reconcile_accounting_type, the rows of 'Pending reconcile' of
+// 'bcachefs fs usage'
+var bchReconcileTypes = []string{
+	"replicas",
+	"checksum",
+	"erasure_code",
+	"compression",
+	"target",
+	"high_priority",
+	"pending",
+}
+
+// enum btree_id
+var bchBtreeIds = []string{
+	"extents",
+	"inodes",
+	"dirents",
+	"xattrs",
+	"alloc",
+	"quotas",
+	"stripes",
+	"reflink",
+	"subvolumes",
+	"snapshots",
+	"lru",
+	"freespace",
+	"need_discard",
+	"backpointers",
+	"bucket_gens",
+	"snapshot_trees",
+	"deleted_inodes",
+	"logged_ops",
+	"rebalance_work",
+	"subvolume_children",
+	"accounting",
+}
+
+// enum disk_accounting_type
+const (
+	accountingPersistentReserved = 1
+	accountingReplicas           = 2
+	accountingCompression        = 4
+	accountingBtree              = 6
+	accountingRebalanceWork      = 7
+	accountingReconcileWork      = 9
+)
+
+const accountingTypesMask = 1<<accountingPersistentReserved |
+	1<<accountingReplicas |
+	1<<accountingCompression |
+	1<<accountingBtree |
+	1<<accountingRebalanceWork |
+	1<<accountingReconcileWork
+
+func enumName(names []string, v int, prefix string) string {
+	if v < len(names) {
+		return names[v]
+	}
+	return prefix + strconv.Itoa(v)
+}
+
+// replicasEntry is struct bch_replicas_entry_v1
+type replicasEntry struct {
+	dataType   string
+	nrRequired int
+	devs       []int
+}
+
+// decodeReplicasEntry returns the entry and its size in bytes
+func decodeReplicasEntry(b []byte) (*replicasEntry, int, error) {
+	if len(b) < 3 {
+		return nil, 0, fmt.Errorf("truncated replicas entry")
+	}
+	nrDevs := int(b[1])
+	if len(b) < 3+nrDevs {
+		return nil, 0, fmt.Errorf("truncated replicas entry with %d devices", nrDevs)
+	}
+	e := &replicasEntry{
+		dataType:   enumName(bchDataTypes, int(b[0]), "data_type_"),
+		nrRequired: int(b[2]),
+		devs:       []int{},
+	}
+	for _, d := range b[3 : 3+nrDevs] {
+		e.devs = append(e.devs, int(d))
+	}
+	return e, 3 + nrDevs, nil
+}
+
+// ioctlDevice describes a member device for naming replicas entries
+type ioctlDevice struct {
+	Name       string // block device name, e.g. 'sdd'
+	Durability int
+}
+
+func (e *replicasEntry) toFsUsageReplica(sectors uint64, devs map[int]ioctlDevice) FsUsageReplica {
+	names := []string{}
+	durability := 0
+	for _, d := range e.devs {
+		dev, ok := devs[d]
+		if !ok || dev.Name == "" {
+			names = append(names, "dev-"+strconv.Itoa(d))
+			continue
+		}
+		names = append(names, dev.Name)
+		durability += dev.Durability
+	}
+	r := FsUsageReplica{
+		DataType:      e.dataType,
+		RequiredTotal: fmt.Sprintf("%d/%d", e.nrRequired, len(e.devs)),
+		Devices:       strings.Join(names, " "),
+		Size:          int(sectors << sectorShift),
+	}
+	if e.dataType != "cached" {
+		r.Durability = strconv.Itoa(durability)
+	}
+	return r
+}
+
+// degraded returns the durability desired for the entry and how much of it
+// is lost to offline devices, as 'bcachefs fs usage' shows them.
+// Unknown devices are taken as offline with a durability of 1.
+func (e *replicasEntry) degraded(devs map[int]ioctlDevice) (string, int) {
+	if e.dataType == "cached" {
+		return "cached", 0
+	}
+	durability := 0
+	degraded := 0
+	offline := 0
+	for _, d := range e.devs {
+		dev, ok := devs[d]
+		if !ok {
+			dev = ioctlDevice{Durability: 1}
+		}
+		durability += dev.Durability
+		if dev.Name == "" {
+			degraded += dev.Durability
+			offline += 1
+		}
+	}
+	if e.nrRequired > 1 {
+		// erasure coded, which survives the loss of all but nrRequired devices
+		durability = len(e.devs) - e.nrRequired + 1
+		degraded = min(offline, durability)
+	}
+	return strconv.Itoa(durability), degraded
+}
+
+// addDegraded adds size to the cell of the degraded table
+func (fs *FsUsage) addDegraded(durability string, degradedBy, size int) {
+	for i, d := range fs.Degraded {
+		if d.DurabilityDesired == durability && d.DegradedBy == degradedBy {
+			fs.Degraded[i].Size += size
+			return
+		}
+	}
+	fs.Degraded = append(fs.Degraded, FsUsageDegraded{
+		DurabilityDesired: durability,
+		DegradedBy:        degradedBy,
+		Size:              size,
+	})
+}
+
+func (fs *FsUsage) sortDegraded() {
+	slices.SortFunc(fs.Degraded, func(a, b FsUsageDegraded) int {
+		return cmp.Or(cmp.Compare(a.DurabilityDesired, b.DurabilityDesired), cmp.Compare(a.DegradedBy, b.DegradedBy))
+	})
+}
+
+func persistentReserved(nrReplicas int, sectors uint64) FsUsageReplica {
+	return FsUsageReplica{
+		DataType:      "reserved",
+		RequiredTotal: fmt.Sprintf("1/%d", nrReplicas),
+		Size:          int(sectors << sectorShift),
+	}
+}
+
+// decodeFsUsage decodes the result of BCH_IOCTL_FS_USAGE
+func decodeFsUsage(b []byte, devs map[int]ioctlDevice) (*FsUsage, error) {
+	if len(b) < fsUsageHeaderSize {
+		return nil, fmt.Errorf("truncated bch_ioctl_fs_usage: %d bytes", len(b))
+	}
+	le := binary.LittleEndian
+	fs := &FsUsage{
+		Capacity:       int(le.Uint64(b[0:]) << sectorShift),
+		Used:           int(le.Uint64(b[8:]) << sectorShift),
+		OnlineReserved: int(le.Uint64(b[16:]) << sectorShift),
+		Replicas:       []FsUsageReplica{},
+		Degraded:       []FsUsageDegraded{},
+	}
+	for i := 0; i < bchReplicasMax; i++ {
+		sectors := le.Uint64(b[24+8*i:])
+		if sectors != 0 {
+			r := persistentReserved(i+1, sectors)
+			fs.Replicas = append(fs.Replicas, r)
+			fs.addDegraded("reserved", 0, r.Size)
+		}
+	}
+
+	entriesBytes := int(le.Uint32(b[56:]))
+	entries := b[fsUsageHeaderSize:]
+	if len(entries) < entriesBytes {
+		return nil, fmt.Errorf("truncated replicas: %d < %d bytes", len(entries), entriesBytes)
+	}
+	entries = entries[:entriesBytes]
+	for len(entries) > 0 {
+		// struct bch_replicas_usage
+		if len(entries) < 8 {
+			return nil, fmt.Errorf("truncated bch_replicas_usage")
+		}
+		sectors := le.Uint64(entries)
+		e, size, err := decodeReplicasEntry(entries[8:])
+		if err != nil {
+			return nil, err
+		}
+		entries = entries[8+size:]
+		r := e.toFsUsageReplica(sectors, devs)
+		fs.Replicas = append(fs.Replicas, r)
+		durability, degradedBy := e.degraded(devs)
+		fs.addDegraded(durability, degradedBy, r.Size)
+	}
+	fs.sortDegraded()
+
+	return fs, nil
+}
+
+// decodeQueryAccounting decodes the result of BCH_IOCTL_QUERY_ACCOUNTING
+func decodeQueryAccounting(b []byte, devs map[int]ioctlDevice) (*FsUsage, error) {
+	if len(b) < queryAccountingHeaderSize {
+		return nil, fmt.Errorf("truncated bch_ioctl_query_accounting: %d bytes", len(b))
+	}
+	le := binary.LittleEndian
+	fs := &FsUsage{
+		Capacity:       int(le.Uint64(b[0:]) << sectorShift),
+		Used:           int(le.Uint64(b[8:]) << sectorShift),
+		OnlineReserved: int(le.Uint64(b[16:]) << sectorShift),
+		Replicas:       []FsUsageReplica{},
+		Degraded:       []FsUsageDegraded{},
+		Compressions:   []FsUsageCompression{},
+		Btrees:         []FsUsageBtree{},
+		Reconcile:      map[string]FsUsageReconcile{},
+	}
+
+	keysBytes := int(le.Uint32(b[24:])) * 8
+	keys := b[queryAccountingHeaderSize:]
+	if len(keys) < keysBytes {
+		return nil, fmt.Errorf("truncated accounting keys: %d < %d bytes", len(keys), keysBytes)
+	}
+	keys = keys[:keysBytes]
+	for len(keys) > 0 {
+		// struct bkey_i_accounting
+		u64s := int(keys[0])
+		if u64s*8 < bkeySize || len(keys) < u64s*8 {
+			return nil, fmt.Errorf("invalid accounting key of %d u64s", u64s)
+		}
+		key := keys[:u64s*8]
+		keys = keys[u64s*8:]
+
+		pos := key[bkeyPosOffset:bkeySize]
+		d := []uint64{}
+		for v := key[bkeySize:]; len(v) >= 8; v = v[8:] {
+			d = append(d, le.Uint64(v))
+		}
+		if len(d) == 0 {
+			return nil, fmt.Errorf("accounting key without counters")
+		}
+
+		switch pos[0] {
+		case accountingPersistentReserved:
+			r := persistentReserved(int(pos[1]), d[0])
+			fs.Replicas = append(fs.Replicas, r)
+			fs.addDegraded("reserved", 0, r.Size)
+		case accountingReplicas:
+			e, _, err := decodeReplicasEntry(pos[1:])
+			if err != nil {
+				return nil, err
+			}
+			r := e.toFsUsageReplica(d[0], devs)
+			fs.Replicas = append(fs.Replicas, r)
+			durability, degradedBy := e.degraded(devs)
+			fs.addDegraded(durability, degradedBy, r.Size)
+		case accountingCompression:
+			// nr extents, uncompressed sectors, compressed sectors
+			if len(d) < 3 {
+				return nil, fmt.Errorf("compression accounting with %d counters", len(d))
+			}
+			c := FsUsageCompression{
+				CompressionType: enumName(bchCompressionTypes, int(pos[1]), "compression_"),
+				Uncompressed:    int64(d[1] << sectorShift),
+				Comporessed:     int64(d[2] << sectorShift),
+			}
+			if d[0] != 0 {
+				c.AverageExtentSize = c.Uncompressed / int64(d[0])
+			}
+			fs.Compressions = append(fs.Compressions, c)
+		case accountingBtree:
+			id := int(le.Uint32(pos[1:]))
+			fs.Btrees = append(fs.Btrees, FsUsageBtree{
+				DataType: enumName(bchBtreeIds, id, "btree_"),
+				Size:     int(d[0] << sectorShift),
+			})
+		case accountingRebalanceWork:
+			// kernels before reconcile only count the pending data, which
+			// the tool prints as 'Pending rebalance work'
+			fs.Reconcile["rebalance_work"] = FsUsageReconcile{
+				Data: int(d[0] << sectorShift),
+			}
+		case accountingReconcileWork:
+			r := FsUsageReconcile{
+				Data: int(d[0] << sectorShift),
+			}
+			if len(d) > 1 {
+				r.Metadata = int(d[1] << sectorShift)
+			}
+			fs.Reconcile[enumName(bchReconcileTypes, int(pos[1]), "reconcile_")] = r
+		}
+	}
+	fs.sortDegraded()
+
+	return fs, nil
+}
+
+// decodeDevUsage decodes the result of BCH_IOCTL_DEV_USAGE or, if v2 is set,
+// of BCH_IOCTL_DEV_USAGE_V2
+func decodeDevUsage(b []byte, v2 bool) ([]FsUsageDeviceData, error) {
+	le := binary.LittleEndian
+	var nrTypes int
+	var types []byte
+	if v2 {
+		if len(b) < devUsageV2HeaderSize {
+			return nil, fmt.Errorf("truncated bch_ioctl_dev_usage_v2: %d bytes", len(b))
+		}
+		nrTypes = int(b[13])
+		types = b[devUsageV2HeaderSize:]
+	} else {
+		if len(b) < devUsageSize {
+			return nil, fmt.Errorf("truncated bch_ioctl_dev_usage: %d bytes", len(b))
+		}
+		nrTypes = devUsageV1DataTypes
+		types = b[40:]
+	}
+	if len(types)/devUsageTypeSize < nrTypes {
+		nrTypes = len(types) / devUsageTypeSize
+	}
+
+	res := []FsUsageDeviceData{}
+	for i := 0; i < nrTypes; i++ {
+		t := types[i*devUsageTypeSize:]
+		fragmented := le.Uint64(t[16:])
+		res = append(res, FsUsageDeviceData{
+			DataType:      enumName(bchDataTypes, i, "data_type_"),
+			Buckets:       int(le.Uint64(t[0:])),
+			Size:          int(le.Uint64(t[8:]) << sectorShift),
+			HasFragmented: fragmented != 0,
+			Fragmented:    int(fragmented << sectorShift),
+		})
+	}
+	return res, nil
+}
+
+// formatUuid formats the 16 bytes of a __uuid_t
+func formatUuid(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,164 @@
+package bcachefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"unsafe"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/bcachefs/sysfs"
+	"golang.org/x/sys/unix"
+)
+
+// QueryUuid returns the uuid of the bcachefs filesystem path is in, which
+// may be any file or directory inside the mount.
+func QueryUuid(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	return queryUuid(f.Fd())
+}
+
+func queryUuid(fd uintptr) (string, error) {
+	uuidBuf := make([]byte, queryUuidSize)
+	err := ioctl(fd, bchIoctlQueryUuid, uuidBuf)
+	if err != nil {
+		return "", fmt.Errorf("BCH_IOCTL_QUERY_UUID: %v", err)
+	}
+	return formatUuid(uuidBuf), nil
+}
+
+// ReadFsUsage reads the usage of the filesystem mounted at path with the
+// bcachefs ioctls instead of 'bcachefs fs usage'.
+// BCH_IOCTL_QUERY_ACCOUNTING is used when the kernel supports it, otherwise
+// only the replicas are available through BCH_IOCTL_FS_USAGE.
+func ReadFsUsage(path string) (*FsUsage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		// not wrapped, since a missing target is not a missing component
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	fd := f.Fd()
+
+	uuid, err := queryUuid(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := sysfs.ParseSysFsDevMembers(sysfs.Root(), uuid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %v", err)
+	}
+	devs := map[int]ioctlDevice{}
+	for idx, m := range members {
+		devs[idx] = ioctlDevice{
+			Name:       m.BlockDev,
+			Durability: int(m.Durability),
+		}
+	}
+
+	fs, err := queryAccounting(fd, devs)
+	if errors.Is(err, unix.ENOTTY) {
+		fs, err = queryFsUsage(fd, devs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.FileSystem = uuid
+	fs.Path = path
+
+	errs := []error{}
+	for _, idx := range slices.Sorted(maps.Keys(members)) {
+		datas, err := queryDevUsage(fd, idx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get usage of device %d: %w", idx, err))
+			continue
+		}
+		fs.Devices = append(fs.Devices, FsUsageDevice{
+			Device: "device " + strconv.Itoa(idx),
+			Label:  members[idx].Label,
+			Datas:  datas,
+		})
+	}
+
+	return fs, errors.Join(errs...)
+}
+
+func ioctl(fd uintptr, req uintptr, buf []byte) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// retryWithLargerBuffer calls fn with a growing buffer until it no longer
+// fails with ERANGE
+func retryWithLargerBuffer(size int, fn func(buf []byte) error) ([]byte, error) {
+	for {
+		buf := make([]byte, size)
+		err := fn(buf)
+		if !errors.Is(err, unix.ERANGE) {
+			return buf, err
+		}
+		size *= 2
+		if size > 64<<20 {
+			return nil, err
+		}
+	}
+}
+
+func queryAccounting(fd uintptr, devs map[int]ioctlDevice) (*FsUsage, error) {
+	buf, err := retryWithLargerBuffer(64<<10, func(buf []byte) error {
+		binary.LittleEndian.PutUint32(buf[24:], uint32((len(buf)-queryAccountingHeaderSize)/8))
+		binary.LittleEndian.PutUint32(buf[28:], accountingTypesMask)
+		return ioctl(fd, bchIoctlQueryAccounting, buf)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BCH_IOCTL_QUERY_ACCOUNTING: %w", err)
+	}
+	return decodeQueryAccounting(buf, devs)
+}
+
+func queryFsUsage(fd uintptr, devs map[int]ioctlDevice) (*FsUsage, error) {
+	buf, err := retryWithLargerBuffer(4<<10, func(buf []byte) error {
+		binary.LittleEndian.PutUint32(buf[56:], uint32(len(buf)-fsUsageHeaderSize))
+		return ioctl(fd, bchIoctlFsUsage, buf)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BCH_IOCTL_FS_USAGE: %w", err)
+	}
+	return decodeFsUsage(buf, devs)
+}
+
+func queryDevUsage(fd uintptr, idx int) ([]FsUsageDeviceData, error) {
+	const nrTypes = 32
+	buf := make([]byte, devUsageV2HeaderSize+nrTypes*devUsageTypeSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(idx))
+	binary.LittleEndian.PutUint32(buf[8:], bchByIndex)
+	buf[13] = nrTypes
+	err := ioctl(fd, bchIoctlDevUsageV2, buf)
+	if err == nil {
+		return decodeDevUsage(buf, true)
+	}
+	if !errors.Is(err, unix.ENOTTY) {
+		return nil, fmt.Errorf("BCH_IOCTL_DEV_USAGE_V2: %w", err)
+	}
+
+	buf = make([]byte, devUsageSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(idx))
+	binary.LittleEndian.PutUint32(buf[8:], bchByIndex)
+	err = ioctl(fd, bchIoctlDevUsage, buf)
+	if err != nil {
+		return nil, fmt.Errorf("BCH_IOCTL_DEV_USAGE: %w", err)
+	}
+	return decodeDevUsage(buf, false)
+}
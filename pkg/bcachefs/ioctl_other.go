@@ -0,0 +1,13 @@
+//go:build !linux
+
+package bcachefs
+
+import "fmt"
+
+func ReadFsUsage(path string) (*FsUsage, error) {
+	return nil, fmt.Errorf("bcachefs ioctls are only available on linux")
+}
+
+func QueryUuid(path string) (string, error) {
+	return "", fmt.Errorf("bcachefs ioctls are only available on linux")
+}
@@ -0,0 +1,190 @@
+package bcachefs
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var le = binary.LittleEndian
+
+func TestIoctlNumbers(t *testing.T) {
+	assert := assert.New(t)
+	// values of the macros in bcachefs_ioctl.h
+	assert.Equal(uintptr(0x8010bc01), bchIoctlQueryUuid)
+	assert.Equal(uintptr(0xc040bc0b), bchIoctlFsUsage)
+	assert.Equal(uintptr(0xc118bc0b), bchIoctlDevUsage)
+	assert.Equal(uintptr(0xc020bc12), bchIoctlDevUsageV2)
+	assert.Equal(uintptr(0x4020bc15), bchIoctlQueryAccounting)
+}
+
+var testDevs = map[int]ioctlDevice{
+	0: {Name: "sdd", Durability: 1},
+	1: {Name: "sde", Durability: 1},
+	2: {Name: "nvme0n1", Durability: 2},
+}
+
+func TestDecodeFsUsage(t *testing.T) {
+	assert := assert.New(t)
+	buf := make([]byte, fsUsageHeaderSize)
+	le.PutUint64(buf[0:], 1000)
+	le.PutUint64(buf[8:], 600)
+	le.PutUint64(buf[16:], 8)
+	le.PutUint64(buf[24+8:], 16) // persistent_reserved[1]
+	entries := []byte{}
+	// struct bch_replicas_usage
+	entries = le.AppendUint64(entries, 100)
+	entries = append(entries, 3, 2, 1, 0, 1) // btree 1/2 [0 1]
+	entries = le.AppendUint64(entries, 200)
+	entries = append(entries, 4, 1, 1, 2) // user 1/1 [2]
+	entries = le.AppendUint64(entries, 50)
+	entries = append(entries, 5, 1, 1, 2) // cached 1/1 [2]
+	le.PutUint32(buf[56:], uint32(len(entries)))
+	buf = append(buf, entries...)
+	// unused space after the entries
+	buf = append(buf, make([]byte, 64)...)
+
+	fs, err := decodeFsUsage(buf, testDevs)
+	assert.Nil(err)
+	assert.Equal(1000*512, fs.Capacity)
+	assert.Equal(600*512, fs.Used)
+	assert.Equal(8*512, fs.OnlineReserved)
+	assert.Equal([]FsUsageReplica{
+		{DataType: "reserved", RequiredTotal: "1/2", Size: 16 * 512},
+		{DataType: "btree", RequiredTotal: "1/2", Durability: "2", Devices: "sdd sde", Size: 100 * 512},
+		{DataType: "user", RequiredTotal: "1/1", Durability: "2", Devices: "nvme0n1", Size: 200 * 512},
+		{DataType: "cached", RequiredTotal: "1/1", Durability: "", Devices: "nvme0n1", Size: 50 * 512},
+	}, fs.Replicas)
+	assert.Equal([]FsUsageDegraded{
+		{DurabilityDesired: "2", Size: 300 * 512},
+		{DurabilityDesired: "cached", Size: 50 * 512},
+		{DurabilityDesired: "reserved", Size: 16 * 512},
+	}, fs.Degraded)
+
+	_, err = decodeFsUsage(buf[:fsUsageHeaderSize+5], testDevs)
+	assert.NotNil(err)
+}
+
+func TestReplicasEntryDegraded(t *testing.T) {
+	assert := assert.New(t)
+	devs := map[int]ioctlDevice{
+		0: {Name: "sdd", Durability: 1},
+		1: {Durability: 1}, // offline
+		2: {Durability: 2}, // offline
+	}
+	tests := []struct {
+		entry      replicasEntry
+		durability string
+		degraded   int
+	}{
+		{replicasEntry{dataType: "user", nrRequired: 1, devs: []int{0}}, "1", 0},
+		{replicasEntry{dataType: "user", nrRequired: 1, devs: []int{0, 1}}, "2", 1},
+		{replicasEntry{dataType: "btree", nrRequired: 1, devs: []int{1, 2}}, "3", 3},
+		{replicasEntry{dataType: "user", nrRequired: 1, devs: []int{0, 5}}, "2", 1},
+		{replicasEntry{dataType: "cached", nrRequired: 1, devs: []int{1}}, "cached", 0},
+		// erasure coded
+		{replicasEntry{dataType: "user", nrRequired: 2, devs: []int{0, 1, 2}}, "2", 2},
+	}
+	for _, test := range tests {
+		durability, degraded := test.entry.degraded(devs)
+		assert.Equal(test.durability, durability, test.entry)
+		assert.Equal(test.degraded, degraded, test.entry)
+	}
+}
+
+// accountingKey builds a struct bkey_i_accounting
+func accountingKey(pos []byte, d ...uint64) []byte {
+	key := make([]byte, bkeySize)
+	key[0] = byte(5 + len(d))
+	copy(key[bkeyPosOffset:], pos)
+	for _, v := range d {
+		key = le.AppendUint64(key, v)
+	}
+	return key
+}
+
+func TestDecodeQueryAccounting(t *testing.T) {
+	assert := assert.New(t)
+	buf := make([]byte, queryAccountingHeaderSize)
+	le.PutUint64(buf[0:], 1000)
+	le.PutUint64(buf[8:], 600)
+	le.PutUint64(buf[16:], 8)
+
+	keys := []byte{}
+	keys = append(keys, accountingKey([]byte{accountingPersistentReserved, 1}, 4)...)
+	keys = append(keys, accountingKey([]byte{accountingReplicas, 4, 2, 1, 0, 1}, 300)...)
+	keys = append(keys, accountingKey([]byte{accountingCompression, 4}, 10, 2000, 500)...)
+	keys = append(keys, accountingKey([]byte{accountingBtree, 1, 0, 0, 0}, 64)...)
+	keys = append(keys, accountingKey([]byte{accountingBtree, 99, 0, 0, 0}, 32)...)
+	keys = append(keys, accountingKey([]byte{accountingRebalanceWork}, 128)...)
+	keys = append(keys, accountingKey([]byte{accountingReconcileWork, 4}, 16, 8)...)
+	le.PutUint32(buf[24:], uint32(len(keys)/8))
+	buf = append(buf, keys...)
+
+	fs, err := decodeQueryAccounting(buf, testDevs)
+	assert.Nil(err)
+	assert.Equal(1000*512, fs.Capacity)
+	assert.Equal([]FsUsageReplica{
+		{DataType: "reserved", RequiredTotal: "1/1", Size: 4 * 512},
+		{DataType: "user", RequiredTotal: "1/2", Durability: "2", Devices: "sdd sde", Size: 300 * 512},
+	}, fs.Replicas)
+	assert.Equal([]FsUsageDegraded{
+		{DurabilityDesired: "2", Size: 300 * 512},
+		{DurabilityDesired: "reserved", Size: 4 * 512},
+	}, fs.Degraded)
+	assert.Equal([]FsUsageCompression{
+		{CompressionType: "zstd", Comporessed: 500 * 512, Uncompressed: 2000 * 512, AverageExtentSize: 2000 * 512 / 10},
+	}, fs.Compressions)
+	assert.Equal([]FsUsageBtree{
+		{DataType: "inodes", Size: 64 * 512},
+		{DataType: "btree_99", Size: 32 * 512},
+	}, fs.Btrees)
+	assert.Equal(map[string]FsUsageReconcile{
+		"rebalance_work": {Data: 128 * 512},
+		// keyed like 'Pending reconcile' of the tool
+		"target": {Data: 16 * 512, Metadata: 8 * 512},
+	}, fs.Reconcile)
+
+	// a key claiming to be larger than the buffer
+	buf[queryAccountingHeaderSize] = 100
+	_, err = decodeQueryAccounting(buf, testDevs)
+	assert.NotNil(err)
+}
+
+func TestDecodeDevUsage(t *testing.T) {
+	assert := assert.New(t)
+	v2 := make([]byte, devUsageV2HeaderSize)
+	v2[13] = 2
+	v2 = le.AppendUint64(v2, 100) // free buckets
+	v2 = le.AppendUint64(v2, 0)
+	v2 = le.AppendUint64(v2, 0)
+	v2 = le.AppendUint64(v2, 1) // sb
+	v2 = le.AppendUint64(v2, 8)
+	v2 = le.AppendUint64(v2, 1016)
+	// capacity for more data types which the kernel did not fill
+	v2 = append(v2, make([]byte, devUsageTypeSize*4)...)
+
+	datas, err := decodeDevUsage(v2, true)
+	assert.Nil(err)
+	assert.Equal([]FsUsageDeviceData{
+		{DataType: "free", Buckets: 100},
+		{DataType: "sb", Size: 8 * 512, Buckets: 1, HasFragmented: true, Fragmented: 1016 * 512},
+	}, datas)
+
+	v1 := make([]byte, devUsageSize)
+	le.PutUint64(v1[40+devUsageTypeSize*4:], 7)
+	le.PutUint64(v1[40+devUsageTypeSize*4+8:], 56)
+	datas, err = decodeDevUsage(v1, false)
+	assert.Nil(err)
+	assert.Equal(10, len(datas))
+	assert.Equal(FsUsageDeviceData{DataType: "user", Size: 56 * 512, Buckets: 7}, datas[4])
+
+	_, err = decodeDevUsage(v1[:100], false)
+	assert.NotNil(err)
+}
+
+func TestFormatUuid(t *testing.T) {
+	b := []byte{0xa9, 0xda, 0x1e, 0x6e, 0xd4, 0xe5, 0x47, 0x17, 0xa5, 0x20, 0x40, 0x8c, 0x8a, 0xf4, 0xb0, 0x84}
+	assert.Equal(t, "a9da1e6e-d4e5-4717-a520-408c8af4b084", formatUuid(b))
+}
@@ -0,0 +1,299 @@
+package bcachefs
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+)
+
+type Superblock struct {
+	ExternalUuid           string             `json:"external_uuid"`
+	Label                  string             `json:"label"`
+	Version                SuperblockVersion  `json:"version"`
+	VersionUpgradeComplete SuperblockVersion  `json:"version_upgrade_complete"`
+	OldestVersionOnDisk    SuperblockVersion  `json:"oldest_version_on_disk"`
+	Sequence               int64              `json:"sequence"`
+	Clean                  bool               `json:"clean"`
+	Features               []string           `json:"features"`
+	CompatFeatures         []string           `json:"compat_features"`
+	Members                []SuperblockMember `json:"members"`
+	DiskGroups             []SuperblockGroup  `json:"disk_groups"`
+	Replicas               []FsUsageReplica   `json:"replicas"` // without Durability and Size
+	Errors                 []SuperblockError  `json:"errors"`
+}
+
+// SuperblockVersion is a version like '1.25: extent_flags'
+type SuperblockVersion struct {
+	Number string `json:"number"`
+	Name   string `json:"name"`
+}
+
+type SuperblockMember struct {
+	Index       int       `json:"index"`
+	Label       string    `json:"label"`
+	Uuid        string    `json:"uuid"`
+	Size        int64     `json:"size"`
+	State       string    `json:"state"`
+	LastMount   time.Time `json:"last_mount"` // zero if never mounted
+	DataAllowed []string  `json:"data_allowed"`
+	HasData     []string  `json:"has_data"`
+	Durability  int64     `json:"durability"`
+	Discard     bool      `json:"discard"`
+}
+
+type SuperblockGroup struct {
+	Index   int    `json:"index"`
+	Label   string `json:"label"`
+	Parent  int    `json:"parent"` // 1 + index of the parent, 0 for none
+	Deleted bool   `json:"deleted"`
+}
+
+// SuperblockError is an entry of the errors fsck has seen and fixed
+type SuperblockError struct {
+	Type     string    `json:"type"`
+	Count    int64     `json:"count"`
+	LastTime time.Time `json:"last_time"`
+}
+
+var (
+	superblockSectionRe = regexp.MustCompile(`^(\S+) \(size \d+\):$`)
+	superblockGroupRe   = regexp.MustCompile(`\[parent (\d+) name ([^\]]*)\]|\[deleted\]`)
+	superblockReplicaRe = regexp.MustCompile(`(\w+): (?:(\d+)/)?(\d+) \[([\d ]*)\]`)
+	superblockErrorRe   = regexp.MustCompile(`^(\S+)\s+(\d+)\s*(.*)$`)
+	superblockLabelRe   = regexp.MustCompile(` \(\d+\)$`)
+)
+
+// layouts of the times printed by the kernel, in UTC. The tool prints
+// times with ctime(), in time.ANSIC and in local time.
+var superblockTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+// ParseShowSuper parses the output of 'bcachefs show-super -f all'.
+// Unknown entries and sections are skipped so that newer versions of the
+// tool can be parsed, and lines which cannot be parsed are reported as
+// *utils.ParseError in the returned error.
+func ParseShowSuper(results string) (*Superblock, error) {
+	sb := &Superblock{
+		Features:       []string{},
+		CompatFeatures: []string{},
+		Members:        []SuperblockMember{},
+		DiskGroups:     []SuperblockGroup{},
+		Replicas:       []FsUsageReplica{},
+		Errors:         []SuperblockError{},
+	}
+
+	errs := []error{}
+	section := ""
+	var member *SuperblockMember
+	for i, l := range strings.Split(results, "\n") {
+		lineNum := i + 1
+		line := strings.TrimSpace(l)
+		if line == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+
+		var err error
+		if l == line {
+			// not indented
+			if m := superblockSectionRe.FindStringSubmatch(line); m != nil {
+				section = m[1]
+				member = nil
+				continue
+			}
+			if value == "" {
+				// e.g. 'Options:'
+				section = key
+				continue
+			}
+			section = ""
+			err = sb.parseEntry(key, value)
+		} else {
+			switch strings.TrimRight(section, "_v0123456789") {
+			case "members":
+				if key == "Device" || (strings.HasPrefix(key, "Device ") && value == "") {
+					// 'Device: 0' or 'Device 0:' of older versions
+					sb.Members = append(sb.Members, SuperblockMember{})
+					member = &sb.Members[len(sb.Members)-1]
+					member.Index, err = strconv.Atoi(strings.TrimPrefix(key+value, "Device"))
+				} else if member != nil {
+					err = member.parseEntry(key, value)
+				}
+			case "disk_groups":
+				sb.DiskGroups = append(sb.DiskGroups, parseSuperblockGroups(line, len(sb.DiskGroups))...)
+			case "replicas":
+				var replicas []FsUsageReplica
+				replicas, err = parseSuperblockReplicas(line)
+				sb.Replicas = append(sb.Replicas, replicas...)
+			case "errors":
+				var e *SuperblockError
+				e, err = parseSuperblockError(line)
+				if e != nil {
+					sb.Errors = append(sb.Errors, *e)
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, utils.NewParseError("show_super", lineNum, line, err))
+		}
+	}
+
+	return sb, errors.Join(errs...)
+}
+
+func (sb *Superblock) parseEntry(key, value string) error {
+	var err error
+	switch key {
+	case "External UUID":
+		sb.ExternalUuid = value
+	case "Label":
+		sb.Label = value
+	case "Version":
+		sb.Version = parseSuperblockVersion(value)
+	case "Version upgrade complete":
+		sb.VersionUpgradeComplete = parseSuperblockVersion(value)
+	case "Oldest version on disk":
+		sb.OldestVersionOnDisk = parseSuperblockVersion(value)
+	case "Sequence number":
+		sb.Sequence, err = strconv.ParseInt(value, 10, 64)
+	case "Clean":
+		sb.Clean = value != "0"
+	case "Features":
+		sb.Features = parseSuperblockFlags(value)
+	case "Compat features":
+		sb.CompatFeatures = parseSuperblockFlags(value)
+	}
+	return err
+}
+
+func (m *SuperblockMember) parseEntry(key, value string) error {
+	var err error
+	switch key {
+	case "Label":
+		// 'hdd.hdd1 (3)' with the index of the disk group, or '(none)'
+		if value != "(none)" {
+			m.Label = superblockLabelRe.ReplaceAllString(value, "")
+		}
+	case "UUID":
+		m.Uuid = value
+	case "Size":
+		m.Size, err = utils.ParseSizeWithUnit(strings.Fields(value))
+	case "State":
+		m.State = value
+	case "Last mount":
+		if value != "(never)" {
+			m.LastMount, err = parseSuperblockTime(value)
+		}
+	case "Data allowed":
+		m.DataAllowed = parseSuperblockFlags(value)
+	case "Has data":
+		m.HasData = parseSuperblockFlags(value)
+	case "Durability":
+		m.Durability, err = strconv.ParseInt(value, 10, 64)
+	case "Discard":
+		m.Discard = value != "0"
+	}
+	return err
+}
+
+func parseSuperblockVersion(s string) SuperblockVersion {
+	number, name, _ := strings.Cut(s, ":")
+	return SuperblockVersion{
+		Number: strings.TrimSpace(number),
+		Name:   strings.TrimSpace(name),
+	}
+}
+
+func parseSuperblockFlags(s string) []string {
+	res := []string{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f != "" && f != "(none)" {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func parseSuperblockTime(s string) (time.Time, error) {
+	t, err := time.ParseInLocation(time.ANSIC, s, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range superblockTimeLayouts {
+		t, err = time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseSuperblockGroups parses groups like '[parent 0 name hdd] [deleted]',
+// the first of which has the index first.
+func parseSuperblockGroups(s string, first int) []SuperblockGroup {
+	res := []SuperblockGroup{}
+	for i, m := range superblockGroupRe.FindAllStringSubmatch(s, -1) {
+		g := SuperblockGroup{Index: first + i}
+		if m[1] == "" {
+			g.Deleted = true
+		} else {
+			g.Parent, _ = strconv.Atoi(m[1])
+			g.Label = m[2]
+		}
+		res = append(res, g)
+	}
+	return res
+}
+
+// parseSuperblockReplicas parses entries like 'user: 1/2 [0 1] btree: 1/2 [0 1]'
+func parseSuperblockReplicas(s string) ([]FsUsageReplica, error) {
+	res := []FsUsageReplica{}
+	matches := superblockReplicaRe.FindAllStringSubmatch(s, -1)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no replicas entry")
+	}
+	for _, m := range matches {
+		devs := strings.Fields(m[4])
+		required := m[2]
+		if required == "" {
+			// replicas_v0 without nr_required
+			required = "1"
+		}
+		res = append(res, FsUsageReplica{
+			DataType:      m[1],
+			RequiredTotal: fmt.Sprintf("%s/%d", required, len(devs)),
+			Devices:       strings.Join(devs, " "),
+		})
+	}
+	return res, nil
+}
+
+// parseSuperblockError parses an entry like
+// 'journal_entry_dup_same_device   1   Wed Oct  2 13:22:08 2024'
+func parseSuperblockError(s string) (*SuperblockError, error) {
+	m := superblockErrorRe.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("unexpected format")
+	}
+	count, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	e := &SuperblockError{
+		Type:  m[1],
+		Count: count,
+	}
+	if m[3] != "" {
+		e.LastTime, err = parseSuperblockTime(m[3])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
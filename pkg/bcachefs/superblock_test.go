@@ -0,0 +1,150 @@
+package bcachefs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testShowSuper = `Device:                                     WDC WD140EDGZ-11
+External UUID:                              a9da1e6e-d4e5-4717-a520-408c8af4b084
+Internal UUID:                              1e8cbd5e-8b1c-4b5a-a2a6-0f1f6f0b7d2c
+Magic number:                               c68573f6-66ce-90a9-d96a-60cf803df7ef
+Device index:                               0
+Label:                                      tank
+Version:                                    1.25: extent_flags
+Incompatible features allowed:              1.25: extent_flags
+Incompatible features in use:               0.0: (unknown version)
+Version upgrade complete:                   1.20: directory_size
+Oldest version on disk:                     1.3: rebalance_work
+Created:                                    Sat Jan  6 07:38:20 2024
+Sequence number:                            1234
+Time of last write:                         Mon Jul 14 10:22:01 2025
+Superblock size:                            5.52 KiB/1.00 MiB
+Clean:                                      0
+Devices:                                    2
+Sections:                                   members_v1,replicas_v0,disk_groups,clean,counters,members_v2,errors,ext
+Features:                                   lz4,zstd,reflink,new_siphash,inline_data
+Compat features:                            alloc_info,alloc_metadata
+
+Options:
+  block_size:                               4.00 KiB
+  errors:                                   continue [fix_safe] panic ro
+
+replicas_v0 (size 40):
+  journal: 1/2 [0 1] btree: 1/2 [0 1] user: 1/1 [1]
+
+disk_groups (size 40):
+  [parent 0 name hdd] [deleted] [parent 1 name hdd1]
+
+errors (size 40):
+  journal_entry_dup_same_device             1               Wed Oct  2 13:22:08 2024
+  btree_node_bad_seq                        12              2025-07-13T11:41:32
+
+members_v2 (size 592):
+  Device:                                   0
+    Label:                                  hdd1 (2)
+    UUID:                                   a2b0a1d4-2f5e-4b3d-8e0b-7d6c5f4e3a21
+    Size:                                   3.64 TiB
+    read errors:                            0
+    Bucket size:                            512 KiB
+    Last mount:                             Sun Jul 13 11:41:32 2025
+    State:                                  rw
+    Data allowed:                           journal,btree,user
+    Has data:                               journal,btree,user
+    Durability:                             1
+    Discard:                                1
+  Device:                                   1
+    Label:                                  (none)
+    UUID:                                   b3c1b2e5-3f6a-4c4e-9f1c-8e7d6a5f4b32
+    Size:                                   1.00 TiB
+    Last mount:                             (never)
+    State:                                  ro
+    Data allowed:                           journal,btree,user
+    Has data:                               (none)
+    Durability:                             2
+    Discard:                                0
+`
+
+func TestParseShowSuper(t *testing.T) {
+	assert := assert.New(t)
+	// times printed by the tool are in local time
+	local := time.Local
+	time.Local = time.FixedZone("JST", 9*60*60)
+	defer func() { time.Local = local }()
+	sb, err := ParseShowSuper(testShowSuper)
+	assert.Nil(err)
+
+	assert.Equal("a9da1e6e-d4e5-4717-a520-408c8af4b084", sb.ExternalUuid)
+	assert.Equal("tank", sb.Label)
+	assert.Equal(SuperblockVersion{Number: "1.25", Name: "extent_flags"}, sb.Version)
+	assert.Equal(SuperblockVersion{Number: "1.20", Name: "directory_size"}, sb.VersionUpgradeComplete)
+	assert.Equal(SuperblockVersion{Number: "1.3", Name: "rebalance_work"}, sb.OldestVersionOnDisk)
+	assert.Equal(int64(1234), sb.Sequence)
+	assert.False(sb.Clean)
+	assert.Equal([]string{"lz4", "zstd", "reflink", "new_siphash", "inline_data"}, sb.Features)
+	assert.Equal([]string{"alloc_info", "alloc_metadata"}, sb.CompatFeatures)
+
+	assert.Equal([]FsUsageReplica{
+		{DataType: "journal", RequiredTotal: "1/2", Devices: "0 1"},
+		{DataType: "btree", RequiredTotal: "1/2", Devices: "0 1"},
+		{DataType: "user", RequiredTotal: "1/1", Devices: "1"},
+	}, sb.Replicas)
+	assert.Equal([]SuperblockGroup{
+		{Index: 0, Label: "hdd", Parent: 0},
+		{Index: 1, Deleted: true},
+		{Index: 2, Label: "hdd1", Parent: 1},
+	}, sb.DiskGroups)
+
+	assert.Equal([]SuperblockError{
+		{Type: "journal_entry_dup_same_device", Count: 1, LastTime: time.Date(2024, 10, 2, 13, 22, 8, 0, time.Local)},
+		{Type: "btree_node_bad_seq", Count: 12, LastTime: time.Date(2025, 7, 13, 11, 41, 32, 0, time.UTC)},
+	}, sb.Errors)
+
+	assert.Equal([]SuperblockMember{
+		{
+			Index:       0,
+			Label:       "hdd1",
+			Uuid:        "a2b0a1d4-2f5e-4b3d-8e0b-7d6c5f4e3a21",
+			Size:        4002222325104,
+			State:       "rw",
+			LastMount:   time.Date(2025, 7, 13, 11, 41, 32, 0, time.Local),
+			DataAllowed: []string{"journal", "btree", "user"},
+			HasData:     []string{"journal", "btree", "user"},
+			Durability:  1,
+			Discard:     true,
+		},
+		{
+			Index:       1,
+			Uuid:        "b3c1b2e5-3f6a-4c4e-9f1c-8e7d6a5f4b32",
+			Size:        1099511627776,
+			State:       "ro",
+			DataAllowed: []string{"journal", "btree", "user"},
+			HasData:     []string{},
+			Durability:  2,
+		},
+	}, sb.Members)
+}
+
+func TestParseShowSuperWithErrors(t *testing.T) {
+	assert := assert.New(t)
+	input := `External UUID:                              a9da1e6e-d4e5-4717-a520-408c8af4b084
+Sequence number:                            many
+
+errors (size 16):
+  btree_node_bad_seq                        12              yesterday
+  journal_entry_dup_same_device             1               Wed Oct  2 13:22:08 2024
+`
+
+	sb, err := ParseShowSuper(input)
+	assert.Equal("a9da1e6e-d4e5-4717-a520-408c8af4b084", sb.ExternalUuid)
+	assert.Equal(1, len(sb.Errors))
+
+	var pe *utils.ParseError
+	assert.True(errors.As(err, &pe))
+	assert.Equal("show_super", pe.Section)
+	assert.Equal(2, pe.Line)
+}
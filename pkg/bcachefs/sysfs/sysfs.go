@@ -1,149 +1,194 @@
 package sysfs
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
 
 	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
-	log "github.com/sirupsen/logrus"
 )
 
 var SYSFS_PATH_PREFIX = "/sys/fs/bcachefs"
 
+// Root returns SYSFS_PATH_PREFIX, the directory the parsers of this package
+// read from.
+func Root() fs.FS {
+	return os.DirFS(SYSFS_PATH_PREFIX)
+}
+
 type SysFsStat struct {
-	BtreeWriteStat  []SysFsBtreeWriteStat
-	BtreeCacheSize  int64
-	CompressionStat []SysFsCompressionStat
-	RebalanceStatus *SysFsRebalanceStatus
+	BtreeWriteStat  []SysFsBtreeWriteStat  `json:"btree_write_stat"`
+	BtreeCacheSize  int64                  `json:"btree_cache_size"`
+	CompressionStat []SysFsCompressionStat `json:"compression_stat"`
+	RebalanceStatus *SysFsRebalanceStatus  `json:"rebalance_status"`
 }
 
 type SysFsBtreeWriteStat struct {
-	Stat string
-	NR   int64
-	Size int64
+	Stat string `json:"stat"`
+	NR   int64  `json:"nr"`
+	Size int64  `json:"size"`
 }
 
 type SysFsCompressionStat struct {
-	CompressionType   string
-	Comporessed       int64
-	Uncompressed      int64
-	AverageExtentSize int64
+	CompressionType   string `json:"compression_type"`
+	Comporessed       int64  `json:"compressed"`
+	Uncompressed      int64  `json:"uncompressed"`
+	AverageExtentSize int64  `json:"average_extent_size"`
 }
 
 type SysFsRebalanceStatus struct {
-	State      string
-	DataType   string
-	KeysMoved  int64
-	KeysRaced  int64
-	BytesSeen  int64
-	BytesMoved int64
-	BytesRaced int64
+	// e.g. 'waiting', 'working' or 'scanning'. Other states are kept as is.
+	State       string                  `json:"state"`
+	PendingWork int64                   `json:"pending_work"` // in bytes
+	Contexts    []SysFsRebalanceContext `json:"contexts"`
+}
+
+// SysFsRebalanceStates are the states of rebalance known to the kernel
+var SysFsRebalanceStates = []string{"waiting", "working", "scanning"}
+
+// SysFsRebalanceContext is a context moving data like 'rebalance_work'
+type SysFsRebalanceContext struct {
+	Name       string `json:"name"`
+	DataType   string `json:"data_type"`
+	Pos        string `json:"pos"`
+	KeysMoved  int64  `json:"keys_moved"`
+	KeysRaced  int64  `json:"keys_raced"`
+	BytesSeen  int64  `json:"bytes_seen"`
+	BytesMoved int64  `json:"bytes_moved"`
+	BytesRaced int64  `json:"bytes_raced"`
 }
 
-func ParseSysFs(uuid string) (*SysFsStat, error) {
+// ListFileSystems returns the UUIDs of the filesystems registered in sysfs.
+func ListFileSystems(fsys fs.FS) ([]string, error) {
+	items, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, item := range items {
+		if !uuidRe.MatchString(item.Name()) {
+			continue
+		}
+		res = append(res, item.Name())
+	}
+
+	return res, nil
+}
+
+var uuidRe = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// ParseSysFs parses the files directly under the filesystem's sysfs directory.
+// Files that do not exist are skipped. On other failures the result holds
+// everything that could be parsed and the failures are returned joined.
+func ParseSysFs(fsys fs.FS, uuid string) (*SysFsStat, error) {
 	res := &SysFsStat{
 		BtreeWriteStat:  nil,
 		CompressionStat: nil,
 		RebalanceStatus: nil,
 	}
 
+	errs := []error{}
 	var err error
-	res.BtreeWriteStat, err = ParseSysFsBtreeWriteStats(uuid)
-	if err != nil && os.IsExist(err) {
-		return nil, fmt.Errorf("failed to parse 'btree_write_stats': %v", err)
+	res.BtreeWriteStat, err = ParseSysFsBtreeWriteStats(fsys, uuid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to parse 'btree_write_stats': %w", err))
 	}
 
-	res.BtreeCacheSize, err = ParseSysFsBtreeCacheSize(uuid)
-	if err != nil && os.IsExist(err) {
-		return nil, fmt.Errorf("failed to parse 'btree_cache_size': %v", err)
+	res.BtreeCacheSize, err = ParseSysFsBtreeCacheSize(fsys, uuid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to parse 'btree_cache_size': %w", err))
 	}
 
-	res.CompressionStat, err = ParseSysFsCompressionStats(uuid)
-	if err != nil && os.IsExist(err) {
-		return nil, fmt.Errorf("failed to parse 'compression_stats': %v", err)
+	res.CompressionStat, err = ParseSysFsCompressionStats(fsys, uuid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to parse 'compression_stats': %w", err))
 	}
 
-	res.RebalanceStatus, err = ParseSysFsRebalanceStatus(uuid)
-	if err != nil && os.IsExist(err) {
-		return nil, fmt.Errorf("failed to parse 'rebalance_status': %v", err)
+	res.RebalanceStatus, err = ParseSysFsRebalanceStatus(fsys, uuid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to parse 'rebalance_status': %w", err))
 	}
 
-	return res, nil
+	return res, errors.Join(errs...)
 }
 
-func ParseSysFsBtreeWriteStats(uuid string) ([]SysFsBtreeWriteStat, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid, "btree_write_stats")
-	data, err := os.ReadFile(path)
+func ParseSysFsBtreeWriteStats(fsys fs.FS, uuid string) ([]SysFsBtreeWriteStat, error) {
+	data, err := fs.ReadFile(fsys, path.Join(uuid, "btree_write_stats"))
 	if err != nil {
 		return nil, err
 	}
 
-	return parseSysFsBtreeWriteStats(string(data)), nil
+	return parseSysFsBtreeWriteStats(string(data))
 }
 
-func ParseSysFsBtreeCacheSize(uuid string) (int64, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid, "btree_cache_size")
-	data, err := os.ReadFile(path)
+func ParseSysFsBtreeCacheSize(fsys fs.FS, uuid string) (int64, error) {
+	data, err := fs.ReadFile(fsys, path.Join(uuid, "btree_cache_size"))
 	if err != nil {
 		return 0, err
 	}
 
-	return parseSysFsBtreeCacheSize(string(data)), nil
+	return parseSysFsBtreeCacheSize(string(data))
 }
 
-func ParseSysFsCompressionStats(uuid string) ([]SysFsCompressionStat, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid, "compression_stats")
-	data, err := os.ReadFile(path)
+func ParseSysFsCompressionStats(fsys fs.FS, uuid string) ([]SysFsCompressionStat, error) {
+	data, err := fs.ReadFile(fsys, path.Join(uuid, "compression_stats"))
 	if err != nil {
 		return nil, err
 	}
 
-	return parseSysFsCompressionStats(string(data)), nil
+	return parseSysFsCompressionStats(string(data))
 }
 
-func ParseSysFsRebalanceStatus(uuid string) (*SysFsRebalanceStatus, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid, "rebalance_status")
-	data, err := os.ReadFile(path)
+// ParseSysFsRebalanceStatus parses 'rebalance_status', or 'reconcile_status'
+// of kernels where rebalance is renamed to reconcile.
+func ParseSysFsRebalanceStatus(fsys fs.FS, uuid string) (*SysFsRebalanceStatus, error) {
+	data, err := fs.ReadFile(fsys, path.Join(uuid, "rebalance_status"))
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = fs.ReadFile(fsys, path.Join(uuid, "reconcile_status"))
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return parseSysFsRebalanceStatus(string(data)), nil
+	return parseSysFsRebalanceStatus(string(data))
 }
 
-func parseSysFsBtreeWriteStats(s string) []SysFsBtreeWriteStat {
+func parseSysFsBtreeWriteStats(s string) ([]SysFsBtreeWriteStat, error) {
 	lines := strings.Split(s, "\n")
-	if len(lines) == 0 {
-		return nil
-	}
 	header := strings.Fields(lines[0])
 	if len(header) < 2 || header[0] != "nr" || header[1] != "size" {
-		log.Fatalf("unexpected format: %s", strings.Join(header, " "))
+		return nil, utils.NewParseError("btree_write_stats", 1, lines[0], fmt.Errorf("unexpected format"))
 	}
 
+	errs := []error{}
 	res := []SysFsBtreeWriteStat{}
-	for _, rawLine := range lines[1:] {
+	for i, rawLine := range lines[1:] {
+		lineNum := i + 2
 		fields := strings.Fields(rawLine)
 		if len(fields) == 0 {
 			continue
 		}
 		if len(fields) < 3 {
-			log.Fatalf("unexpected format: %s", rawLine)
+			errs = append(errs, utils.NewParseError("btree_write_stats", lineNum, rawLine, fmt.Errorf("too few fields")))
+			continue
 		}
 
 		nr, err := strconv.ParseInt(fields[1], 10, 64)
 		if err != nil {
-			log.Fatalf("failed to parse 'nr': %v", err)
+			errs = append(errs, utils.NewParseError("btree_write_stats", lineNum, rawLine, fmt.Errorf("failed to parse 'nr': %v", err)))
+			continue
 		}
 
 		size, err := parseSizeWithUnitWithoutSpace(fields[2])
 		if err != nil {
-			log.Fatalf("failed to parse 'size': %v", err)
+			errs = append(errs, utils.NewParseError("btree_write_stats", lineNum, rawLine, fmt.Errorf("failed to parse 'size': %v", err)))
+			continue
 		}
 
 		res = append(res, SysFsBtreeWriteStat{
@@ -153,7 +198,7 @@ func parseSysFsBtreeWriteStats(s string) []SysFsBtreeWriteStat {
 		})
 	}
 
-	return res
+	return res, errors.Join(errs...)
 }
 
 func parseSizeWithUnitWithoutSpace(s string) (int64, error) {
@@ -191,43 +236,53 @@ func splitNumericAndUnit(s string) (string, string) {
 	return s[:idx], s[idx:]
 }
 
-func parseSysFsBtreeCacheSize(s string) int64 {
-	size, err := parseSizeWithUnitWithoutSpace(strings.ReplaceAll(s, "\n", ""))
+func parseSysFsBtreeCacheSize(s string) (int64, error) {
+	line := strings.ReplaceAll(s, "\n", "")
+	size, err := parseSizeWithUnitWithoutSpace(line)
 	if err != nil {
-		log.Fatalf("failed to parse 'size': %v", err)
+		return 0, utils.NewParseError("btree_cache_size", 1, line, err)
 	}
-	return size
+	return size, nil
 }
 
-func parseSysFsCompressionStats(s string) []SysFsCompressionStat {
+func parseSysFsCompressionStats(s string) ([]SysFsCompressionStat, error) {
 	re := regexp.MustCompile(`\s+`)
 	lines := strings.Split(s, "\n")
 	line := re.ReplaceAllString(lines[0], " ")
 	if line != "typetype compressed uncompressed average extent size" {
-		log.Fatalf("unexpected format: %s", line)
+		return nil, utils.NewParseError("compression_stats", 1, line, fmt.Errorf("unexpected format"))
 	}
 
+	errs := []error{}
 	res := []SysFsCompressionStat{}
-	for _, line := range lines[1:] {
+	for i, line := range lines[1:] {
+		lineNum := i + 2
 		if line == "" {
 			continue
 		}
 		line = re.ReplaceAllString(line, " ")
 		seps := strings.Split(line, " ")
+		if len(seps) < 4 {
+			errs = append(errs, utils.NewParseError("compression_stats", lineNum, line, fmt.Errorf("too few fields")))
+			continue
+		}
 
 		compType := seps[0]
 		compressed, err := parseSizeWithUnitWithoutSpace(seps[1])
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("compression_stats", lineNum, line, err))
+			continue
 		}
 
 		uncompressed, err := parseSizeWithUnitWithoutSpace(seps[2])
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("compression_stats", lineNum, line, err))
+			continue
 		}
 		avgExtent, err := parseSizeWithUnitWithoutSpace(seps[3])
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("compression_stats", lineNum, line, err))
+			continue
 		}
 
 		res = append(res, SysFsCompressionStat{
@@ -238,72 +293,84 @@ func parseSysFsCompressionStats(s string) []SysFsCompressionStat {
 		})
 	}
 
-	return res
+	return res, errors.Join(errs...)
 }
 
-func parseSysFsRebalanceStatus(s string) *SysFsRebalanceStatus {
-	var err error
-	re := regexp.MustCompile(`\s+`)
-	lines := strings.Split(s, "\n")
-	res := &SysFsRebalanceStatus{}
-	idx := 0
-	cont := true
-	for cont {
-		line := re.ReplaceAllString(lines[idx], " ")
-		idx += 1
-		if line == "" {
+// parseSysFsRebalanceStatus parses the output like
+//
+//	pending work:                  10.7 TiB
+//
+//	working
+//	  rebalance_work: data type==user pos=extents:296331:3240:U32_MAX
+//	    keys moved:                89
+//	    ...
+//
+//	  [<0>] bch2_rebalance_thread+0x65/0xb0 [bcachefs]
+//
+// Details of the state other than the contexts, and the stack trace of the
+// thread are ignored.
+func parseSysFsRebalanceStatus(s string) (*SysFsRebalanceStatus, error) {
+	res := &SysFsRebalanceStatus{
+		Contexts: []SysFsRebalanceContext{},
+	}
+	var ctx *SysFsRebalanceContext
+	errs := []error{}
+	for i, l := range strings.Split(s, "\n") {
+		lineNum := i + 1
+		line := strings.TrimSpace(l)
+		if line == "" || strings.HasPrefix(line, "[<") {
 			continue
 		}
-		switch line {
-		case "waiting":
-			return res
-		case "scanning", "working":
-			// ok
+		key, value, hasValue := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		indented := l != line
+
+		var err error
+		switch {
+		case !indented && !hasValue:
 			res.State = line
-			cont = false
-		default:
-			// pending work:                  10.7 TiB
-			//
-			// working
-			seps := strings.Split(line, ":")
-			switch seps[0] {
-			case "pending work":
-				// ok
-				continue
-			default:
-				log.Fatalf("unknown rebalance state '%s' '%s'", line, seps)
-			}
-		}
-	}
-	// parse 'user' from ' rebalance_scan: data type==user pos=extents:1752400415:4096:U32_MAX'
-	re2 := regexp.MustCompile(`.*data type==|\spos.*`)
-	res.DataType = re2.ReplaceAllString(lines[idx], "")
-	idx += 1
-	for _, line := range lines[idx:] {
-		line = re.ReplaceAllString(line, " ")
-		if line == "" || line == " " {
+			ctx = nil
+		case !indented && key == "pending work":
+			res.PendingWork, err = utils.ParseSizeWithUnit(strings.Fields(value))
+		case !indented:
+			// unknown entries are left for newer kernels
 			continue
-		}
-		seps := strings.Split(line, ":")
-		switch seps[0] {
-		case " keys moved":
-			res.KeysMoved, err = strconv.ParseInt(strings.ReplaceAll(seps[1], " ", ""), 10, 64)
-		case " keys raced":
-			res.KeysRaced, err = strconv.ParseInt(strings.ReplaceAll(seps[1], " ", ""), 10, 64)
-		case " bytes seen":
-			res.BytesSeen, err = utils.ParseSizeWithUnit(strings.Split(seps[1], " ")[1:3])
-		case " bytes moved":
-			res.BytesMoved, err = utils.ParseSizeWithUnit(strings.Split(seps[1], " ")[1:3])
-		case " bytes raced":
-			res.BytesRaced, err = utils.ParseSizeWithUnit(strings.Split(seps[1], " ")[1:3])
+		case hasValue && (strings.Contains(value, "data type==") || strings.Contains(value, "pos=")):
+			res.Contexts = append(res.Contexts, parseSysFsRebalanceContext(key, value))
+			ctx = &res.Contexts[len(res.Contexts)-1]
+		case ctx == nil:
+			// details of the state
+			continue
+		case key == "keys moved":
+			ctx.KeysMoved, err = strconv.ParseInt(value, 10, 64)
+		case key == "keys raced":
+			ctx.KeysRaced, err = strconv.ParseInt(value, 10, 64)
+		case key == "bytes seen":
+			ctx.BytesSeen, err = utils.ParseSizeWithUnit(strings.Fields(value))
+		case key == "bytes moved":
+			ctx.BytesMoved, err = utils.ParseSizeWithUnit(strings.Fields(value))
+		case key == "bytes raced":
+			ctx.BytesRaced, err = utils.ParseSizeWithUnit(strings.Fields(value))
 		default:
-			if strings.Contains(seps[0], " [<0>") {
-				continue
-			}
-			log.Fatalf("unknown type '%s' in line '%s'", seps[0], line)
+			// counters of newer kernels
+			continue
 		}
 		if err != nil {
-			log.Fatalf("unexpected line: '%s': %v", line, err)
+			errs = append(errs, utils.NewParseError("rebalance_status", lineNum, line, err))
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// parseSysFsRebalanceContext parses the header of a context like
+// 'rebalance_scan: data type==user pos=extents:1752400415:4096:U32_MAX'
+func parseSysFsRebalanceContext(name, s string) SysFsRebalanceContext {
+	res := SysFsRebalanceContext{Name: name}
+	for _, f := range strings.Fields(s) {
+		if v, ok := strings.CutPrefix(f, "type=="); ok {
+			res.DataType = v
+		} else if v, ok := strings.CutPrefix(f, "pos="); ok {
+			res.Pos = v
 		}
 	}
 	return res
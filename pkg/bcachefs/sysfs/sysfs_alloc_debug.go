@@ -0,0 +1,163 @@
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+)
+
+// SysFsAllocDebug is the content of 'internal/alloc_debug' of the
+// filesystem or 'alloc_debug' of a device. The items differ between
+// kernels, so they are kept as printed.
+type SysFsAllocDebug struct {
+	// e.g. 'capacity', 'open buckets allocated' or 'buckets to invalidate'
+	Values map[string]int64 `json:"values"`
+	// waitlists like 'freelist_wait', 'empty' or 'waiting'
+	Waits map[string]string `json:"waits"`
+	// buckets reserved for each watermark, e.g. 'btree' or 'copygc'
+	Reserves map[string]int64 `json:"reserves"`
+	// usage of the device by data type, e.g. 'free' or 'need_discard'
+	Usage map[string]SysFsAllocDebugUsage `json:"usage"`
+}
+
+type SysFsAllocDebugUsage struct {
+	Buckets    int64 `json:"buckets"`
+	Sectors    int64 `json:"sectors"`
+	Fragmented int64 `json:"fragmented"` // in sectors
+}
+
+// header of the usage table of a device
+var sysFsAllocDebugUsageHeader = []string{"buckets", "sectors", "fragmented"}
+
+// ParseSysFsAllocDebug parses 'internal/alloc_debug'.
+func ParseSysFsAllocDebug(fsys fs.FS, uuid string) (*SysFsAllocDebug, error) {
+	data, err := fs.ReadFile(fsys, path.Join(uuid, "internal", "alloc_debug"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSysFsAllocDebug(string(data))
+}
+
+// ParseSysFsDevAllocDebug parses 'alloc_debug' of every member device,
+// keyed by the 'dev-N' directory name.
+// Devices without the file are omitted, and a device is included as far
+// as it could be parsed, with the failures reported in the returned error.
+func ParseSysFsDevAllocDebug(fsys fs.FS, uuid string) (map[string]SysFsAllocDebug, error) {
+	dir := uuid
+	items, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	errs := []error{}
+	res := map[string]SysFsAllocDebug{}
+	for _, item := range items {
+		name := item.Name()
+		if !strings.HasPrefix(name, "dev-") {
+			continue
+		}
+
+		p := path.Join(dir, name, "alloc_debug")
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+			continue
+		}
+		d, err := parseSysFsAllocDebug(string(b))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+		}
+		res[name] = *d
+	}
+
+	return res, errors.Join(errs...)
+}
+
+// parseSysFsAllocDebug parses lines like 'open buckets allocated  12' and
+// 'freelist_wait  empty', the 'reserves:' section and the usage table
+// starting with 'buckets sectors fragmented'. A section or the table ends
+// at a blank line. Only the first of items printed twice (e.g. 'reserved')
+// is kept.
+func parseSysFsAllocDebug(s string) (*SysFsAllocDebug, error) {
+	res := &SysFsAllocDebug{
+		Values:   map[string]int64{},
+		Waits:    map[string]string{},
+		Reserves: map[string]int64{},
+		Usage:    map[string]SysFsAllocDebugUsage{},
+	}
+	errs := []error{}
+	section := ""
+	inUsage := false
+	for i, l := range strings.Split(s, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			section = ""
+			inUsage = false
+			continue
+		}
+		if slices.Equal(fields, sysFsAllocDebugUsageHeader) {
+			inUsage = true
+			continue
+		}
+		if len(fields) == 1 && strings.HasSuffix(fields[0], ":") {
+			section = strings.TrimSuffix(fields[0], ":")
+			continue
+		}
+		if len(fields) < 2 {
+			errs = append(errs, utils.NewParseError("alloc_debug", i+1, l, fmt.Errorf("too few fields")))
+			continue
+		}
+
+		if inUsage && len(fields) == 1+len(sysFsAllocDebugUsageHeader) {
+			values := make([]int64, len(sysFsAllocDebugUsageHeader))
+			var err error
+			for j := range values {
+				values[j], err = strconv.ParseInt(fields[1+j], 10, 64)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				errs = append(errs, utils.NewParseError("alloc_debug", i+1, l, err))
+				continue
+			}
+			res.Usage[fields[0]] = SysFsAllocDebugUsage{
+				Buckets:    values[0],
+				Sectors:    values[1],
+				Fragmented: values[2],
+			}
+			continue
+		}
+
+		key := strings.TrimSuffix(strings.Join(fields[:len(fields)-1], " "), ":")
+		value := fields[len(fields)-1]
+		if value == "empty" || value == "waiting" {
+			res.Waits[key] = value
+			continue
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs = append(errs, utils.NewParseError("alloc_debug", i+1, l, err))
+			continue
+		}
+		switch section {
+		case "reserves":
+			res.Reserves[key] = v
+		case "":
+			if _, ok := res.Values[key]; !ok {
+				res.Values[key] = v
+			}
+		}
+	}
+
+	return res, errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+package sysfs
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSysFsAllocDebug(t *testing.T) {
+	assert := assert.New(t)
+	root := testSysFs()
+	res, err := ParseSysFsAllocDebug(root, testUuid)
+	assert.Nil(err)
+	assert.Equal(int64(15625000000), res.Values["capacity"])
+	// the first 'reserved' is kept
+	assert.Equal(int64(1093750000), res.Values["reserved"])
+	assert.Equal(int64(12), res.Values["open buckets allocated"])
+	assert.Equal(int64(32), res.Values["btree reserve cache"])
+	assert.Equal(map[string]string{"freelist_wait": "empty", "open_buckets_wait": "empty"}, res.Waits)
+	assert.Empty(res.Reserves)
+	assert.Empty(res.Usage)
+
+	_, err = ParseSysFsAllocDebug(root, "not-a-filesystem")
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestParseSysFsDevAllocDebug(t *testing.T) {
+	assert := assert.New(t)
+	res, err := ParseSysFsDevAllocDebug(testSysFs(), testUuid)
+	assert.Nil(err)
+	// dev-2 lacks alloc_debug
+	assert.Equal(1, len(res))
+
+	d := res["dev-0"]
+	assert.Equal(map[string]int64{"capacity": 7630915, "open buckets": 7, "buckets to invalidate": 0}, d.Values)
+	assert.Empty(d.Waits)
+	assert.Equal(map[string]int64{"stripe": 238468, "normal": 119242, "copygc": 23, "btree": 11}, d.Reserves)
+	assert.Equal(7, len(d.Usage))
+	assert.Equal(SysFsAllocDebugUsage{Buckets: 12034, Sectors: 6123456, Fragmented: 38912}, d.Usage["btree"])
+	assert.Equal(int64(3), d.Usage["need_discard"].Buckets)
+}
+
+func TestParseSysFsAllocDebugWithErrors(t *testing.T) {
+	assert := assert.New(t)
+	input := `capacity                15625000000
+open buckets allocated  x
+freelist_wait
+nr_inodes               1234567
+`
+	res, err := parseSysFsAllocDebug(input)
+	var perr *utils.ParseError
+	assert.ErrorAs(err, &perr)
+	assert.Equal(2, perr.Line)
+	assert.Equal(map[string]int64{"capacity": 15625000000, "nr_inodes": 1234567}, res.Values)
+}
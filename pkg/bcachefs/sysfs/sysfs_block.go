@@ -0,0 +1,177 @@
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+)
+
+// SysFsDevBlock is the block device backing a member device
+type SysFsDevBlock struct {
+	Name  string `json:"name"` // e.g. 'sda' or 'nvme0n1'
+	Major int64  `json:"major"`
+	Minor int64  `json:"minor"`
+}
+
+// SysFsBlockStat is the content of the 'stat' file of a block device.
+// See Documentation/block/stat.rst of the kernel.
+// Discard and flush are zero on kernels which do not report them.
+type SysFsBlockStat struct {
+	ReadIos        int64 `json:"read_ios"`
+	ReadMerges     int64 `json:"read_merges"`
+	ReadSectors    int64 `json:"read_sectors"`
+	ReadTicks      int64 `json:"read_ticks"` // in milliseconds
+	WriteIos       int64 `json:"write_ios"`
+	WriteMerges    int64 `json:"write_merges"`
+	WriteSectors   int64 `json:"write_sectors"`
+	WriteTicks     int64 `json:"write_ticks"`
+	InFlight       int64 `json:"in_flight"`
+	IoTicks        int64 `json:"io_ticks"`
+	TimeInQueue    int64 `json:"time_in_queue"`
+	DiscardIos     int64 `json:"discard_ios"`
+	DiscardMerges  int64 `json:"discard_merges"`
+	DiscardSectors int64 `json:"discard_sectors"`
+	DiscardTicks   int64 `json:"discard_ticks"`
+	FlushIos       int64 `json:"flush_ios"`
+	FlushTicks     int64 `json:"flush_ticks"`
+}
+
+// SysFsDevBlockStat is the SysFsBlockStat of the block device backing a
+// member device, with the uuid and label of the member.
+type SysFsDevBlockStat struct {
+	Uuid  string `json:"uuid"`
+	Label string `json:"label"`
+	SysFsBlockStat
+}
+
+// parseSysFsDevBlock reads the 'block' link of the member device in dir.
+// nil is returned for offline members, which have no block device.
+func parseSysFsDevBlock(fsys fs.FS, dir string) (*SysFsDevBlock, error) {
+	uevent, err := fs.ReadFile(fsys, path.Join(dir, "block", "uevent"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uevent of block device: %w", err)
+	}
+	res := &SysFsDevBlock{
+		Name: parseUevent(string(uevent))["DEVNAME"],
+	}
+
+	p := path.Join(dir, "block", "dev")
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return res, fmt.Errorf("failed to read '%s': %w", p, err)
+	}
+	line := strings.TrimSpace(string(b))
+	major, minor, ok := strings.Cut(line, ":")
+	if !ok {
+		return res, utils.NewParseError("block", 1, line, fmt.Errorf("missing ':'"))
+	}
+	res.Major, err = strconv.ParseInt(major, 10, 64)
+	if err != nil {
+		return res, utils.NewParseError("block", 1, line, err)
+	}
+	res.Minor, err = strconv.ParseInt(minor, 10, 64)
+	if err != nil {
+		return res, utils.NewParseError("block", 1, line, err)
+	}
+
+	return res, nil
+}
+
+// ParseSysFsDevBlockStats parses the 'stat' of the block device backing
+// each member device, keyed by the 'dev-N' directory name.
+// Offline members are omitted, and a member whose uuid or label fails to
+// be read is included without it.
+func ParseSysFsDevBlockStats(fsys fs.FS, uuid string) (map[string]SysFsDevBlockStat, error) {
+	dir := uuid
+	items, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	errs := []error{}
+	res := map[string]SysFsDevBlockStat{}
+	for _, item := range items {
+		name := item.Name()
+		if !strings.HasPrefix(name, "dev-") {
+			continue
+		}
+
+		p := path.Join(dir, name, "block", "stat")
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+			continue
+		}
+		stat, err := parseSysFsBlockStat(string(b))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+			continue
+		}
+		devStat := SysFsDevBlockStat{SysFsBlockStat: *stat}
+		for _, f := range []struct {
+			name string
+			dst  *string
+		}{{"uuid", &devStat.Uuid}, {"label", &devStat.Label}} {
+			p := path.Join(dir, name, f.name)
+			b, err := fs.ReadFile(fsys, p)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+				continue
+			}
+			*f.dst = strings.Split(string(b), "\n")[0]
+		}
+		res[name] = devStat
+	}
+
+	return res, errors.Join(errs...)
+}
+
+func parseSysFsBlockStat(s string) (*SysFsBlockStat, error) {
+	line := strings.Split(s, "\n")[0]
+	fields := strings.Fields(line)
+	// 11 fields before 4.18, 15 before 5.5 and 17 since then
+	if len(fields) < 11 {
+		return nil, utils.NewParseError("block_stat", 1, line, fmt.Errorf("too few fields"))
+	}
+	values := make([]int64, 17)
+	for i, f := range fields {
+		if i >= len(values) {
+			break
+		}
+		v, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, utils.NewParseError("block_stat", 1, line, err)
+		}
+		values[i] = v
+	}
+
+	return &SysFsBlockStat{
+		ReadIos:        values[0],
+		ReadMerges:     values[1],
+		ReadSectors:    values[2],
+		ReadTicks:      values[3],
+		WriteIos:       values[4],
+		WriteMerges:    values[5],
+		WriteSectors:   values[6],
+		WriteTicks:     values[7],
+		InFlight:       values[8],
+		IoTicks:        values[9],
+		TimeInQueue:    values[10],
+		DiscardIos:     values[11],
+		DiscardMerges:  values[12],
+		DiscardSectors: values[13],
+		DiscardTicks:   values[14],
+		FlushIos:       values[15],
+		FlushTicks:     values[16],
+	}, nil
+}
@@ -0,0 +1,61 @@
+package sysfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSysFsBlockStat(t *testing.T) {
+	assert := assert.New(t)
+	stat, err := parseSysFsBlockStat(testBlockStat)
+	assert.Nil(err)
+	assert.Equal(&SysFsBlockStat{
+		ReadIos:        148230,
+		ReadMerges:     12010,
+		ReadSectors:    96523554,
+		ReadTicks:      620180,
+		WriteIos:       301822,
+		WriteMerges:    99751,
+		WriteSectors:   181355744,
+		WriteTicks:     2711036,
+		InFlight:       0,
+		IoTicks:        741196,
+		TimeInQueue:    3490368,
+		DiscardIos:     1024,
+		DiscardMerges:  0,
+		DiscardSectors: 2097152,
+		DiscardTicks:   120,
+		FlushIos:       20650,
+		FlushTicks:     159032,
+	}, stat)
+
+	// older kernels without discard and flush
+	stat, err = parseSysFsBlockStat("1 2 3 4 5 6 7 8 9 10 11\n")
+	assert.Nil(err)
+	assert.Equal(int64(11), stat.TimeInQueue)
+	assert.Equal(int64(0), stat.FlushIos)
+
+	_, err = parseSysFsBlockStat("1 2 3\n")
+	var pe *utils.ParseError
+	assert.True(errors.As(err, &pe))
+	assert.Equal("block_stat", pe.Section)
+}
+
+func TestParseSysFsDevBlockStats(t *testing.T) {
+	assert := assert.New(t)
+	root := testSysFs()
+	stats, err := ParseSysFsDevBlockStats(root, testUuid)
+	assert.Nil(err)
+	// dev-2 is offline
+	assert.Equal(1, len(stats))
+	assert.Equal(int64(148230), stats["dev-0"].ReadIos)
+	assert.Equal("a2b0a1d4-2f5e-4b3d-8e0b-7d6c5f4e3a21", stats["dev-0"].Uuid)
+	assert.Equal("hdd.hdd1", stats["dev-0"].Label)
+
+	root[testUuid+"/dev-0/block/stat"].Data = []byte("x\n")
+	_, err = ParseSysFsDevBlockStats(root, testUuid)
+	assert.NotNil(err)
+}
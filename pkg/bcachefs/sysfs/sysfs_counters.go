@@ -1,39 +1,48 @@
 package sysfs
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"path"
 	"regexp"
 	"strings"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
 )
 
 type SysFsCounter struct {
-	Mount    int64 // since mount
-	Creation int64 // since file system creation
+	Mount    int64 `json:"mount"`    // since mount
+	Creation int64 `json:"creation"` // since file system creation
 }
 
-func ParseSysFsCounters(uuid string) (map[string]SysFsCounter, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid, "counters")
-	items, err := os.ReadDir(path)
+// ParseSysFsCounters parses every file in 'counters'.
+// Files which fail to be parsed are omitted from the result and reported
+// in the returned error.
+func ParseSysFsCounters(fsys fs.FS, uuid string) (map[string]SysFsCounter, error) {
+	dir := path.Join(uuid, "counters")
+	items, err := fs.ReadDir(fsys, dir)
 	if err != nil {
 		return nil, err
 	}
+	errs := []error{}
 	res := map[string]SysFsCounter{}
 	for _, item := range items {
-		p := filepath.Join(path, item.Name())
-		data, err := os.ReadFile(p)
+		p := path.Join(dir, item.Name())
+		data, err := fs.ReadFile(fsys, p)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", item.Name(), err)
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", item.Name(), err))
+			continue
 		}
 		s, err := parseSysFsCounter(string(data))
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", item.Name(), err)
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", item.Name(), err))
+			continue
 		}
 		res[item.Name()] = *s
 	}
 
-	return res, nil
+	return res, errors.Join(errs...)
 }
 
 func parseSysFsCounter(s string) (*SysFsCounter, error) {
@@ -41,7 +50,7 @@ func parseSysFsCounter(s string) (*SysFsCounter, error) {
 	lines := strings.Split(s, "\n")
 	cnt := &SysFsCounter{}
 	var err error
-	for _, l := range lines {
+	for i, l := range lines {
 		if l == "" {
 			continue
 		}
@@ -49,16 +58,20 @@ func parseSysFsCounter(s string) (*SysFsCounter, error) {
 		l := re.ReplaceAllString(l, " ")
 		seps := strings.Split(l, " ")
 		if len(seps) < 3 {
-			return nil, fmt.Errorf("unexpected line '%s'", l)
+			return nil, utils.NewParseError("counters", i+1, l, fmt.Errorf("too few fields"))
 		}
 		switch seps[1] {
 		case "mount:":
 			cnt.Mount, err = parseSizeWithUnitWithoutSpace(seps[2])
 		case "filesystem":
+			if len(seps) < 4 {
+				err = fmt.Errorf("too few fields")
+				break
+			}
 			cnt.Creation, err = parseSizeWithUnitWithoutSpace(seps[3])
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", l, err)
+			return nil, utils.NewParseError("counters", i+1, l, err)
 		}
 	}
 
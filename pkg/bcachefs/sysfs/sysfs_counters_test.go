@@ -27,3 +27,19 @@ since filesystem creation:     176T
 	assert.Equal(int64(7690000000), c.Mount)
 	assert.Equal(int64(176000000000000), c.Creation)
 }
+
+func TestParseSysFsCounters(t *testing.T) {
+	assert := assert.New(t)
+	root := testSysFs()
+	counters, err := ParseSysFsCounters(root, testUuid)
+	assert.Nil(err)
+	assert.Equal(map[string]SysFsCounter{
+		"io_read":      {Mount: 7690000000, Creation: 176000000000000},
+		"bucket_alloc": {Mount: 1, Creation: 551},
+	}, counters)
+
+	root[testUuid+"/counters/io_read"].Data = []byte("since mount: x y\n")
+	counters, err = ParseSysFsCounters(root, testUuid)
+	assert.NotNil(err)
+	assert.Equal(map[string]SysFsCounter{"bucket_alloc": {Mount: 1, Creation: 551}}, counters)
+}
@@ -1,9 +1,10 @@
 package sysfs
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,35 +13,54 @@ import (
 )
 
 type SysFsDev struct {
-	Label          string
-	Uuid           string
-	BucketSize     int64
-	NBuckets       int64
-	FirstBucket    int64
-	Durability     int64
-	IoDone         *SysFsDevIoDone
-	IoErrors       *SysFsDevIoErrors
-	IoLatencyRead  *SysFsTimeStat
-	IoLatencyWrite *SysFsTimeStat
+	Label          string                 `json:"label"`
+	Uuid           string                 `json:"uuid"`
+	BucketSize     int64                  `json:"bucket_size"`
+	NBuckets       int64                  `json:"nbuckets"`
+	FirstBucket    int64                  `json:"first_bucket"`
+	Durability     int64                  `json:"durability"`
+	State          string                 `json:"state"`
+	States         []string               `json:"states"` // every state listed in 'state'
+	DataAllowed    []string               `json:"data_allowed"`
+	HasData        []string               `json:"has_data"`
+	Discard        bool                   `json:"discard"`
+	Block          *SysFsDevBlock         `json:"block"` // nil if offline
+	Options        map[string]SysFsOption `json:"options"`
+	IoDone         *SysFsDevIoDone        `json:"io_done"`
+	IoErrors       *SysFsDevIoErrors      `json:"io_errors"`
+	IoLatencyRead  *SysFsTimeStat         `json:"io_latency_read"`
+	IoLatencyWrite *SysFsTimeStat         `json:"io_latency_write"`
 }
 
 type SysFsDevIoDone struct {
-	Read  map[string]int64
-	Write map[string]int64
+	Read  map[string]int64 `json:"read"`
+	Write map[string]int64 `json:"write"`
 }
 
 type SysFsDevIoErrors struct {
-	Read     int64
-	Write    int64
-	Checksum int64
+	SinceCreation SysFsDevIoErrorCounts `json:"since_creation"`
+	// errors since the counters were last reset, which is RecentSeconds ago.
+	// nil if the kernel does not print them.
+	Recent        *SysFsDevIoErrorCounts `json:"recent"`
+	RecentSeconds float64                `json:"recent_seconds"`
 }
 
-func ParseSysFsDevs(uuid string) (map[string]SysFsDev, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid)
-	items, err := os.ReadDir(path)
+type SysFsDevIoErrorCounts struct {
+	Read     int64 `json:"read"`
+	Write    int64 `json:"write"`
+	Checksum int64 `json:"checksum"`
+}
+
+// ParseSysFsDevs parses every 'dev-N' directory of the filesystem.
+// A device is included as far as it could be parsed, and the failures are
+// reported in the returned error.
+func ParseSysFsDevs(fsys fs.FS, uuid string) (map[string]SysFsDev, error) {
+	dir := uuid
+	items, err := fs.ReadDir(fsys, dir)
 	if err != nil {
 		return nil, err
 	}
+	errs := []error{}
 	res := map[string]SysFsDev{}
 	for _, item := range items {
 		name := item.Name()
@@ -48,118 +68,278 @@ func ParseSysFsDevs(uuid string) (map[string]SysFsDev, error) {
 			continue
 		}
 
-		p := filepath.Join(path, name)
-		d, err := parseSysFsDev(p)
+		p := path.Join(dir, name)
+		d, err := parseSysFsDev(fsys, p)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", p, err)
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
 		}
 		res[name] = *d
 	}
 
+	return res, errors.Join(errs...)
+}
+
+// SysFsDevMember identifies a member device
+type SysFsDevMember struct {
+	Label      string `json:"label"`
+	BlockDev   string `json:"block_dev"` // name of the backing block device, empty if offline
+	Durability int64  `json:"durability"`
+}
+
+// ParseSysFsDevMembers reads the identity of each member device,
+// keyed by its index.
+func ParseSysFsDevMembers(fsys fs.FS, uuid string) (map[int]SysFsDevMember, error) {
+	dir := uuid
+	items, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := map[int]SysFsDevMember{}
+	for _, item := range items {
+		name := item.Name()
+		if !strings.HasPrefix(name, "dev-") {
+			continue
+		}
+		idx, err := strconv.Atoi(strings.TrimPrefix(name, "dev-"))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected device '%s': %v", name, err)
+		}
+
+		p := path.Join(dir, name)
+		m := SysFsDevMember{}
+		labelBytes, err := fs.ReadFile(fsys, path.Join(p, "label"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read label of '%s': %v", name, err)
+		}
+		m.Label = strings.Split(string(labelBytes), "\n")[0]
+		m.Durability, err = parseReadInt(fsys, path.Join(p, "durability"))
+		if err != nil {
+			return nil, fmt.Errorf("durability: %w", err)
+		}
+		uevent, err := fs.ReadFile(fsys, path.Join(p, "block", "uevent"))
+		if err == nil {
+			m.BlockDev = parseUevent(string(uevent))["DEVNAME"]
+		}
+		res[idx] = m
+	}
+
 	return res, nil
 }
 
-func parseSysFsDev(path string) (*SysFsDev, error) {
-	res := SysFsDev{}
+// parseUevent parses the KEY=VALUE lines of a 'uevent' file.
+func parseUevent(s string) map[string]string {
+	res := map[string]string{}
+	for _, l := range strings.Split(s, "\n") {
+		k, v, ok := strings.Cut(l, "=")
+		if ok {
+			res[k] = v
+		}
+	}
+	return res
+}
 
-	p := filepath.Join(path, "label")
-	labelBytes, err := os.ReadFile(p)
+// ParseSysFsDevBlockNumbers returns the "major:minor" of the block device
+// backing each member device, keyed by the 'dev-N' directory name.
+func ParseSysFsDevBlockNumbers(fsys fs.FS, uuid string) (map[string]string, error) {
+	dir := uuid
+	items, err := fs.ReadDir(fsys, dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		return nil, err
+	}
+	res := map[string]string{}
+	for _, item := range items {
+		name := item.Name()
+		if !strings.HasPrefix(name, "dev-") {
+			continue
+		}
+
+		p := path.Join(dir, name, "block", "dev")
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			// offline members have no block device
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		}
+		res[name] = strings.TrimSpace(string(b))
 	}
-	res.Label = strings.Split(string(labelBytes), "\n")[0]
 
-	p = filepath.Join(path, "uuid")
-	uuidBytes, err := os.ReadFile(p)
+	return res, nil
+}
+
+// parseSysFsDev always returns a device holding what could be parsed.
+// Fields which failed are left at their zero value.
+func parseSysFsDev(fsys fs.FS, dir string) (*SysFsDev, error) {
+	res := SysFsDev{}
+	errs := []error{}
+
+	p := path.Join(dir, "label")
+	labelBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.Label = strings.Split(string(labelBytes), "\n")[0]
 	}
-	res.Uuid = strings.Split(string(uuidBytes), "\n")[0]
 
-	res.BucketSize, err = parseReadInt(filepath.Join(path, "bucket_size"))
+	p = path.Join(dir, "uuid")
+	uuidBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return nil, fmt.Errorf("bucket_size: %v", err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.Uuid = strings.Split(string(uuidBytes), "\n")[0]
 	}
 
-	res.FirstBucket, err = parseReadInt(filepath.Join(path, "first_bucket"))
+	res.BucketSize, err = parseReadInt(fsys, path.Join(dir, "bucket_size"))
 	if err != nil {
-		return nil, fmt.Errorf("first_bucket: %v", err)
+		errs = append(errs, fmt.Errorf("bucket_size: %w", err))
 	}
 
-	res.NBuckets, err = parseReadInt(filepath.Join(path, "nbuckets"))
+	res.FirstBucket, err = parseReadInt(fsys, path.Join(dir, "first_bucket"))
 	if err != nil {
-		return nil, fmt.Errorf("nbuckets: %v", err)
+		errs = append(errs, fmt.Errorf("first_bucket: %w", err))
 	}
 
-	res.Durability, err = parseReadInt(filepath.Join(path, "durability"))
+	res.NBuckets, err = parseReadInt(fsys, path.Join(dir, "nbuckets"))
 	if err != nil {
-		return nil, fmt.Errorf("durability: %v", err)
+		errs = append(errs, fmt.Errorf("nbuckets: %w", err))
 	}
 
-	p = filepath.Join(path, "io_done")
-	ioDoneBytes, err := os.ReadFile(p)
+	res.Durability, err = parseReadInt(fsys, path.Join(dir, "durability"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("durability: %w", err))
 	}
-	res.IoDone, err = parseSysFsDevIoDone(string(ioDoneBytes))
+
+	res.Block, err = parseSysFsDevBlock(fsys, dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("block: %w", err))
 	}
 
-	p = filepath.Join(path, "io_errors")
-	ioErrorsBytes, err := os.ReadFile(p)
+	p = path.Join(dir, "state")
+	stateBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.State, res.States, err = parseSysFsStringOpt("state", string(stateBytes))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+		}
 	}
-	res.IoErrors, err = parseSysFsDevIoErrors(string(ioErrorsBytes))
+
+	p = path.Join(dir, "data_allowed")
+	dataAllowedBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.DataAllowed = parseSysFsBitflags(string(dataAllowedBytes))
 	}
 
-	p = filepath.Join(path, "io_latency_stats_read")
-	ioLatencyReadBytes, err := os.ReadFile(p)
+	p = path.Join(dir, "has_data")
+	hasDataBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.HasData = parseSysFsBitflags(string(hasDataBytes))
 	}
-	res.IoLatencyRead, err = parseSysFsTimeStat(string(ioLatencyReadBytes), true)
+
+	discard, err := parseReadInt(fsys, path.Join(dir, "discard"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("discard: %w", err))
 	}
+	res.Discard = discard != 0
 
-	p = filepath.Join(path, "io_latency_stats_write")
-	ioLatencyWriteBytes, err := os.ReadFile(p)
+	res.Options, err = parseSysFsDevOptions(fsys, dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("options: %w", err))
 	}
-	res.IoLatencyWrite, err = parseSysFsTimeStat(string(ioLatencyWriteBytes), true)
+
+	p = path.Join(dir, "io_done")
+	ioDoneBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.IoDone, err = parseSysFsDevIoDone(string(ioDoneBytes))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+		}
 	}
 
-	return &res, nil
-}
+	p = path.Join(dir, "io_errors")
+	ioErrorsBytes, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.IoErrors, err = parseSysFsDevIoErrors(string(ioErrorsBytes))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+		}
+	}
 
-func parseReadInt(p string) (int64, error) {
-	b, err := os.ReadFile(p)
+	p = path.Join(dir, "io_latency_stats_read")
+	ioLatencyReadBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read '%s': %v", p, err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.IoLatencyRead, err = parseSysFsTimeStat(string(ioLatencyReadBytes))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+		}
 	}
-	res, err := parseSizeWithUnitWithoutSpace(strings.Split(string(b), "\n")[0])
+
+	p = path.Join(dir, "io_latency_stats_write")
+	ioLatencyWriteBytes, err := fs.ReadFile(fsys, p)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse '%s': %v", string(b), err)
+		errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+	} else {
+		res.IoLatencyWrite, err = parseSysFsTimeStat(string(ioLatencyWriteBytes))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", p, err))
+		}
 	}
 
-	return res, nil
+	return &res, errors.Join(errs...)
+}
+
+// parseSysFsStringOpt parses a choice like '[rw] ro failed spare' and
+// returns the selected one and every choice.
+func parseSysFsStringOpt(section, s string) (string, []string, error) {
+	line := strings.Split(s, "\n")[0]
+	selected := ""
+	choices := []string{}
+	for _, c := range strings.Fields(line) {
+		if strings.HasPrefix(c, "[") && strings.HasSuffix(c, "]") {
+			c = c[1 : len(c)-1]
+			selected = c
+		}
+		choices = append(choices, c)
+	}
+	if selected == "" {
+		return "", nil, utils.NewParseError(section, 1, line, fmt.Errorf("no choice is selected"))
+	}
+	return selected, choices, nil
 }
 
-func parseReadIntWithUnit(p string) (int64, error) {
-	b, err := os.ReadFile(p)
+// parseSysFsBitflags parses flags like 'journal,btree,user'
+func parseSysFsBitflags(s string) []string {
+	res := []string{}
+	for _, f := range strings.Split(strings.Split(s, "\n")[0], ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func parseReadInt(fsys fs.FS, p string) (int64, error) {
+	b, err := fs.ReadFile(fsys, p)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read '%s': %v", p, err)
 	}
-	res, err := utils.ParseSizeWithUnit(strings.Split(strings.Split(string(b), "\n")[0], " "))
+	line := strings.Split(string(b), "\n")[0]
+	res, err := parseSizeWithUnitWithoutSpace(line)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse '%s': %v", string(b), err)
+		return 0, utils.NewParseError(path.Base(p), 1, line, err)
 	}
 
 	return res, nil
@@ -173,7 +353,7 @@ func parseSysFsDevIoDone(s string) (*SysFsDevIoDone, error) {
 
 	mode := ""
 	re := regexp.MustCompile(`\s+`)
-	for _, l := range strings.Split(s, "\n") {
+	for i, l := range strings.Split(s, "\n") {
 		if l == "" {
 			continue
 		}
@@ -183,10 +363,13 @@ func parseSysFsDevIoDone(s string) (*SysFsDevIoDone, error) {
 		}
 
 		seps := strings.Split(l, ":")
+		if len(seps) < 2 {
+			return nil, utils.NewParseError("io_done", i+1, l, fmt.Errorf("missing ':'"))
+		}
 		name := re.ReplaceAllString(seps[0], "")
 		count, err := strconv.ParseInt(re.ReplaceAllString(seps[1], ""), 10, 64)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read '%s': %v", l, err)
+			return nil, utils.NewParseError("io_done", i+1, l, err)
 		}
 
 		switch mode {
@@ -195,27 +378,71 @@ func parseSysFsDevIoDone(s string) (*SysFsDevIoDone, error) {
 		case "write:":
 			res.Write[name] = count
 		default:
-			return nil, fmt.Errorf("mode is not specified")
+			return nil, utils.NewParseError("io_done", i+1, l, fmt.Errorf("mode is not specified"))
 		}
 	}
 
 	return res, nil
 }
 
+// parseSysFsDevIoErrors parses 'io_errors', which has a block of counts
+// since filesystem creation followed by one since e.g. '7 y ago'.
 func parseSysFsDevIoErrors(s string) (*SysFsDevIoErrors, error) {
-	re := regexp.MustCompile(`\s+`)
 	res := &SysFsDevIoErrors{}
 
 	lines := strings.Split(s, "\n")
 	if lines[0] != "IO errors since filesystem creation" {
-		return nil, fmt.Errorf("unexpected line '%s'", lines[0])
+		return nil, utils.NewParseError("io_errors", 1, lines[0], fmt.Errorf("unexpected line"))
+	}
+	if len(lines) < 4 {
+		return nil, utils.NewParseError("io_errors", len(lines), lines[len(lines)-1], fmt.Errorf("truncated"))
+	}
+	var err error
+	res.SinceCreation, err = parseSysFsDevIoErrorCounts(lines[1:4], 2)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, l := range lines[1:4] {
+	if len(lines) < 5 || lines[4] == "" {
+		return res, nil
+	}
+	header := lines[4]
+	ago, ok := strings.CutPrefix(header, "IO errors since ")
+	if ok {
+		ago, ok = strings.CutSuffix(ago, " ago")
+	}
+	if !ok {
+		return nil, utils.NewParseError("io_errors", 5, header, fmt.Errorf("unexpected line"))
+	}
+	res.RecentSeconds, err = utils.ParseTimeWithUnit(strings.Split(ago, " "))
+	if err != nil {
+		return nil, utils.NewParseError("io_errors", 5, header, err)
+	}
+	if len(lines) < 8 {
+		return nil, utils.NewParseError("io_errors", len(lines), lines[len(lines)-1], fmt.Errorf("truncated"))
+	}
+	recent, err := parseSysFsDevIoErrorCounts(lines[5:8], 6)
+	if err != nil {
+		return nil, err
+	}
+	res.Recent = &recent
+
+	return res, nil
+}
+
+// parseSysFsDevIoErrorCounts parses the lines of a block in 'io_errors'
+// starting at line number firstLine.
+func parseSysFsDevIoErrorCounts(lines []string, firstLine int) (SysFsDevIoErrorCounts, error) {
+	re := regexp.MustCompile(`\s+`)
+	res := SysFsDevIoErrorCounts{}
+	for i, l := range lines {
 		seps := strings.Split(l, ":")
+		if len(seps) < 2 {
+			return res, utils.NewParseError("io_errors", firstLine+i, l, fmt.Errorf("missing ':'"))
+		}
 		count, err := strconv.ParseInt(re.ReplaceAllString(seps[1], ""), 10, 64)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", l, err)
+			return res, utils.NewParseError("io_errors", firstLine+i, l, err)
 		}
 		item := re.ReplaceAllString(seps[0], "")
 		switch item {
@@ -226,7 +453,7 @@ func parseSysFsDevIoErrors(s string) (*SysFsDevIoErrors, error) {
 		case "checksum":
 			res.Checksum = count
 		default:
-			return nil, fmt.Errorf("invalid item '%s' in '%s'", item, l)
+			return res, utils.NewParseError("io_errors", firstLine+i, l, fmt.Errorf("invalid item '%s'", item))
 		}
 	}
 
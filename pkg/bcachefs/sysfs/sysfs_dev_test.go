@@ -2,6 +2,7 @@ package sysfs
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -80,7 +81,85 @@ IO errors since 7 y ago
 `
 	ioErrors, err := parseSysFsDevIoErrors(input)
 	assert.Nil(err)
-	assert.Equal(int64(1), ioErrors.Read)
-	assert.Equal(int64(2), ioErrors.Write)
-	assert.Equal(int64(3), ioErrors.Checksum)
+	assert.Equal(int64(1), ioErrors.SinceCreation.Read)
+	assert.Equal(int64(2), ioErrors.SinceCreation.Write)
+	assert.Equal(int64(3), ioErrors.SinceCreation.Checksum)
+	assert.Equal(&SysFsDevIoErrorCounts{}, ioErrors.Recent)
+	assert.Equal(7*60*60*24*365.25, ioErrors.RecentSeconds)
+
+	// older kernels print only the first block
+	ioErrors, err = parseSysFsDevIoErrors(strings.Join(strings.Split(input, "\n")[:4], "\n") + "\n")
+	assert.Nil(err)
+	assert.Equal(int64(3), ioErrors.SinceCreation.Checksum)
+	assert.Nil(ioErrors.Recent)
+
+	_, err = parseSysFsDevIoErrors(strings.Replace(input, "7 y ago", "ever", 1))
+	assert.NotNil(err)
+	_, err = parseSysFsDevIoErrors(strings.Replace(input, "7 y", "7 fortnights", 1))
+	assert.NotNil(err)
+}
+
+func TestParseSysFsStringOpt(t *testing.T) {
+	assert := assert.New(t)
+	selected, choices, err := parseSysFsStringOpt("state", "rw [ro] evacuating spare\n")
+	assert.Nil(err)
+	assert.Equal("ro", selected)
+	assert.Equal([]string{"rw", "ro", "evacuating", "spare"}, choices)
+
+	_, _, err = parseSysFsStringOpt("state", "rw ro failed spare\n")
+	assert.NotNil(err)
+
+	assert.Equal([]string{}, parseSysFsBitflags("\n"))
+	assert.Equal([]string{"user"}, parseSysFsBitflags("user\n"))
+}
+
+func TestParseSysFsDevs(t *testing.T) {
+	assert := assert.New(t)
+	devs, err := ParseSysFsDevs(testSysFs(), testUuid)
+	// dev-2 lacks most of the files
+	assert.NotNil(err)
+	assert.Equal(2, len(devs))
+
+	dev := devs["dev-0"]
+	assert.Equal("hdd.hdd1", dev.Label)
+	assert.Equal("a2b0a1d4-2f5e-4b3d-8e0b-7d6c5f4e3a21", dev.Uuid)
+	assert.Equal(int64(512000), dev.BucketSize)
+	assert.Equal(int64(7630916), dev.NBuckets)
+	assert.Equal(int64(1), dev.FirstBucket)
+	assert.Equal(int64(1), dev.Durability)
+	assert.Equal("rw", dev.State)
+	assert.Equal([]string{"rw", "ro", "failed", "spare"}, dev.States)
+	assert.Equal([]string{"journal", "btree", "user"}, dev.DataAllowed)
+	assert.Equal([]string{"sb", "journal", "btree", "user"}, dev.HasData)
+	assert.True(dev.Discard)
+	assert.Equal(&SysFsDevBlock{Name: "sdd", Major: 8, Minor: 48}, dev.Block)
+	assert.Equal(1, len(dev.Options))
+	assert.Equal(int64(1), *dev.Options["rotational"].Number)
+	assert.Equal(int64(200642920448), dev.IoDone.Read["btree"])
+	assert.Equal(int64(746460282880), dev.IoDone.Write["user"])
+	assert.Equal(SysFsDevIoErrorCounts{Read: 1, Write: 2, Checksum: 3}, dev.IoErrors.SinceCreation)
+	assert.Equal(&SysFsDevIoErrorCounts{Write: 1}, dev.IoErrors.Recent)
+	assert.Equal(int64(484251), dev.IoLatencyRead.Count)
+	assert.Equal(int64(484251), dev.IoLatencyWrite.Count)
+
+	dev = devs["dev-2"]
+	assert.Equal("hdd.hdd3", dev.Label)
+	assert.Equal(int64(2), dev.Durability)
+	assert.Nil(dev.IoDone)
+	assert.Empty(dev.Options)
+}
+
+func TestParseSysFsDevMembers(t *testing.T) {
+	members, err := ParseSysFsDevMembers(testSysFs(), testUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]SysFsDevMember{
+		0: {Label: "hdd.hdd1", BlockDev: "sdd", Durability: 1},
+		2: {Label: "hdd.hdd3", Durability: 2},
+	}, members)
+}
+
+func TestParseSysFsDevBlockNumbers(t *testing.T) {
+	blocks, err := ParseSysFsDevBlockNumbers(testSysFs(), testUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"dev-0": "8:48"}, blocks)
 }
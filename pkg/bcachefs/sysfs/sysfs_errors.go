@@ -0,0 +1,68 @@
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+)
+
+// SysFsError is an entry of 'errors', the errors the filesystem has seen
+// since its creation, which are also recorded in the superblock.
+type SysFsError struct {
+	Count    int64     `json:"count"`
+	LastTime time.Time `json:"last_time"`
+}
+
+// layout of the time of the last error, printed in UTC
+const sysFsErrorTimeLayout = "2006-01-02T15:04:05"
+
+// ParseSysFsErrors parses 'errors', keyed by the name of the error.
+// Lines which fail to be parsed are omitted from the result and reported
+// in the returned error.
+func ParseSysFsErrors(fsys fs.FS, uuid string) (map[string]SysFsError, error) {
+	data, err := fs.ReadFile(fsys, path.Join(uuid, "errors"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSysFsErrors(string(data))
+}
+
+func parseSysFsErrors(s string) (map[string]SysFsError, error) {
+	errs := []error{}
+	res := map[string]SysFsError{}
+	for i, l := range strings.Split(s, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		// the name is '(unknown error N)' for errors newer than the kernel
+		if len(fields) < 3 {
+			errs = append(errs, utils.NewParseError("errors", i+1, l, fmt.Errorf("too few fields")))
+			continue
+		}
+		name := strings.Join(fields[:len(fields)-2], " ")
+		count, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		if err != nil {
+			errs = append(errs, utils.NewParseError("errors", i+1, l, err))
+			continue
+		}
+		lastTime, err := time.Parse(sysFsErrorTimeLayout, fields[len(fields)-1])
+		if err != nil {
+			errs = append(errs, utils.NewParseError("errors", i+1, l, err))
+			continue
+		}
+		res[name] = SysFsError{
+			Count:    count,
+			LastTime: lastTime,
+		}
+	}
+
+	return res, errors.Join(errs...)
+}
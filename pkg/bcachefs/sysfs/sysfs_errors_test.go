@@ -0,0 +1,44 @@
+package sysfs
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSysFsErrors(t *testing.T) {
+	assert := assert.New(t)
+	root := testSysFs()
+	res, err := ParseSysFsErrors(root, testUuid)
+	assert.Nil(err)
+	assert.Equal(map[string]SysFsError{
+		"btree_node_read_error": {
+			Count:    3,
+			LastTime: time.Date(2024, 10, 2, 13, 22, 8, 0, time.UTC),
+		},
+		"(unknown error 999)": {
+			Count:    1,
+			LastTime: time.Date(2025, 1, 15, 0, 3, 41, 0, time.UTC),
+		},
+	}, res)
+
+	_, err = ParseSysFsErrors(root, "not-a-filesystem")
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestParseSysFsErrorsWithErrors(t *testing.T) {
+	assert := assert.New(t)
+	input := `btree_node_read_error                        3  2024-10-02T13:22:08
+bkey_version_in_future                       x  2024-10-02T13:22:08
+journal_entry_dup_same_device                1  2024-10-02 13:22:08
+`
+	res, err := parseSysFsErrors(input)
+	var perr *utils.ParseError
+	assert.ErrorAs(err, &perr)
+	assert.Equal(2, perr.Line)
+	assert.Len(res, 1)
+	assert.Equal(int64(3), res["btree_node_read_error"].Count)
+}
@@ -0,0 +1,89 @@
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SysFsOption is the value of an option of the filesystem or of a device
+type SysFsOption struct {
+	Value  string `json:"value"`  // e.g. 'zstd:3', the selected 'crc32c' of a choice or '2'
+	Number *int64 `json:"number"` // nil unless the value is a number or a size
+}
+
+// options in 'dev-N', which has no 'options' directory. state, data_allowed,
+// durability and discard are not included since SysFsDev has them.
+var sysFsDevOptions = []string{"rotational"}
+
+// ParseSysFsOptions parses every file in 'options'.
+// Files which fail to be read are omitted from the result and reported
+// in the returned error.
+func ParseSysFsOptions(fsys fs.FS, uuid string) (map[string]SysFsOption, error) {
+	dir := path.Join(uuid, "options")
+	items, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	errs := []error{}
+	res := map[string]SysFsOption{}
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, item.Name()))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read '%s': %w", item.Name(), err))
+			continue
+		}
+		res[item.Name()] = parseSysFsOption(string(data))
+	}
+
+	return res, errors.Join(errs...)
+}
+
+// parseSysFsDevOptions reads the options of the member device in dir.
+// Options the kernel does not have are omitted.
+func parseSysFsDevOptions(fsys fs.FS, dir string) (map[string]SysFsOption, error) {
+	errs := []error{}
+	res := map[string]SysFsOption{}
+	for _, name := range sysFsDevOptions {
+		p := path.Join(dir, name)
+		data, err := fs.ReadFile(fsys, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read '%s': %w", p, err))
+			continue
+		}
+		res[name] = parseSysFsOption(string(data))
+	}
+
+	return res, errors.Join(errs...)
+}
+
+// parseSysFsOption parses an option printed like '2', '4.00 KiB',
+// 'zstd:3', 'journal,btree,user' or 'none [crc32c] crc64 xxhash'.
+// Any value is valid, so it never fails.
+func parseSysFsOption(s string) SysFsOption {
+	line := strings.TrimSpace(strings.Split(s, "\n")[0])
+	if selected, _, err := parseSysFsStringOpt("options", line); err == nil {
+		return SysFsOption{Value: selected}
+	}
+
+	opt := SysFsOption{Value: line}
+	if v, err := strconv.ParseInt(line, 10, 64); err == nil {
+		opt.Number = &v
+	} else if line != "" && unicode.IsDigit(rune(line[0])) {
+		// options like block_size may be human readable
+		if v, err := parseSizeWithUnitWithoutSpace(strings.ReplaceAll(line, " ", "")); err == nil {
+			opt.Number = &v
+		}
+	}
+	return opt
+}
@@ -0,0 +1,38 @@
+package sysfs
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSysFsOptions(t *testing.T) {
+	assert := assert.New(t)
+	root := testSysFs()
+	res, err := ParseSysFsOptions(root, testUuid)
+	assert.Nil(err)
+	replicas := int64(2)
+	blockSize := int64(4096)
+	assert.Equal(map[string]SysFsOption{
+		"compression":       {Value: "zstd:3"},
+		"metadata_checksum": {Value: "crc32c"},
+		"metadata_replicas": {Value: "2", Number: &replicas},
+		"foreground_target": {Value: "ssd"},
+		"block_size":        {Value: "4.00 KiB", Number: &blockSize},
+	}, res)
+
+	_, err = ParseSysFsOptions(root, "not-a-filesystem")
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestParseSysFsOption(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(SysFsOption{Value: "journal,btree,user"}, parseSysFsOption("journal,btree,user\n"))
+	assert.Equal(SysFsOption{Value: "none"}, parseSysFsOption("none\n"))
+	assert.Equal(SysFsOption{Value: ""}, parseSysFsOption(""))
+	opt := parseSysFsOption("0\n")
+	assert.Equal(int64(0), *opt.Number)
+	opt = parseSysFsOption("512k\n")
+	assert.Equal(int64(512000), *opt.Number)
+}
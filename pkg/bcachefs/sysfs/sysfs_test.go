@@ -1,12 +1,39 @@
 package sysfs
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestListFileSystems(t *testing.T) {
+	uuids, err := ListFileSystems(testSysFs())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testUuid}, uuids)
+}
+
+func TestParseSysFs(t *testing.T) {
+	assert := assert.New(t)
+	stat, err := ParseSysFs(testSysFs(), testUuid)
+	// a missing rebalance_status is not an error
+	assert.Nil(err)
+	assert.Equal([]SysFsBtreeWriteStat{{Stat: "initial", NR: 4243, Size: 129000}}, stat.BtreeWriteStat)
+	assert.Equal(int64(19100000000), stat.BtreeCacheSize)
+	assert.Equal([]SysFsCompressionStat{{CompressionType: "zstd", Comporessed: 3320000000000, Uncompressed: 9690000000000, AverageExtentSize: 119000}}, stat.CompressionStat)
+	assert.Nil(stat.RebalanceStatus)
+
+	root := testSysFs()
+	root[testUuid+"/btree_cache_size"].Data = []byte("19.1X\n")
+	stat, err = ParseSysFs(root, testUuid)
+	var pe *utils.ParseError
+	assert.True(errors.As(err, &pe))
+	assert.Equal("btree_cache_size", pe.Section)
+	assert.Equal(1, len(stat.BtreeWriteStat))
+}
+
 func TestParseSysFsBtreeWriteStats(t *testing.T) {
 	assert := assert.New(t)
 	input := `                   nr        size
@@ -17,7 +44,8 @@ journal_reclaim:   28651     215
 interior:          4078      285
 `
 
-	stat := parseSysFsBtreeWriteStats(input)
+	stat, err := parseSysFsBtreeWriteStats(input)
+	assert.Nil(err)
 	expectedStats := [][]string{
 		{"initial", "4243", "129000"},
 		{"init_next_bset", "132", "24600"},
@@ -38,7 +66,9 @@ func TestParseSysFsBtreeCacheSize(t *testing.T) {
 	input := `19.1G
 `
 
-	assert.Equal(int64(19100000000), parseSysFsBtreeCacheSize(input))
+	size, err := parseSysFsBtreeCacheSize(input)
+	assert.Nil(err)
+	assert.Equal(int64(19100000000), size)
 }
 
 func TestParseSysFsCompressionStats(t *testing.T) {
@@ -51,7 +81,8 @@ zstd                   3.32T           9.69T                    119k
 incompressible         11.4T           11.4T                   94.7k
 `
 
-	stat := parseSysFsCompressionStats(input)
+	stat, err := parseSysFsCompressionStats(input)
+	assert.Nil(err)
 	expectedStats := [][]string{
 		{"lz4_old", "0", "0", "0"},
 		{"gzip", "0", "0", "0"},
@@ -80,14 +111,18 @@ func TestParseSysFsRebalanceStatus(t *testing.T) {
 
 `
 
-	stat := parseSysFsRebalanceStatus(input)
+	stat, err := parseSysFsRebalanceStatus(input)
+	assert.Nil(err)
 	assert.Equal("scanning", stat.State)
-	assert.Equal("user", stat.DataType)
-	assert.Equal(int64(74602530), stat.KeysMoved)
-	assert.Equal(int64(0), stat.KeysRaced)
-	assert.Equal(int64(13194139533312), stat.BytesSeen)
-	assert.Equal(int64(3925256511160), stat.BytesMoved)
-	assert.Equal(int64(0), stat.BytesRaced)
+	assert.Equal(int64(0), stat.PendingWork)
+	assert.Equal([]SysFsRebalanceContext{{
+		Name:       "rebalance_scan",
+		DataType:   "user",
+		Pos:        "extents:1752400415:4096:U32_MAX",
+		KeysMoved:  74602530,
+		BytesSeen:  13194139533312,
+		BytesMoved: 3925256511160,
+	}}, stat.Contexts)
 }
 
 func TestParseSysFsRebalanceStatus2(t *testing.T) {
@@ -108,12 +143,95 @@ working
   [<0>] ret_from_fork_asm+0x1a/0x30
 `
 
-	stat := parseSysFsRebalanceStatus(input)
+	stat, err := parseSysFsRebalanceStatus(input)
+	assert.Nil(err)
 	assert.Equal("working", stat.State)
-	assert.Equal("user", stat.DataType)
-	assert.Equal(int64(89), stat.KeysMoved)
-	assert.Equal(int64(0), stat.KeysRaced)
-	assert.Equal(int64(3942645), stat.BytesSeen)
-	assert.Equal(int64(3942645), stat.BytesMoved)
-	assert.Equal(int64(0), stat.BytesRaced)
+	assert.Equal(int64(11764774417203), stat.PendingWork)
+	assert.Equal(1, len(stat.Contexts))
+	assert.Equal("rebalance_work", stat.Contexts[0].Name)
+	assert.Equal("user", stat.Contexts[0].DataType)
+	assert.Equal(int64(89), stat.Contexts[0].KeysMoved)
+	assert.Equal(int64(0), stat.Contexts[0].KeysRaced)
+	assert.Equal(int64(3942645), stat.Contexts[0].BytesSeen)
+	assert.Equal(int64(3942645), stat.Contexts[0].BytesMoved)
+	assert.Equal(int64(0), stat.Contexts[0].BytesRaced)
+}
+
+func TestParseSysFsRebalanceStatusWaiting(t *testing.T) {
+	assert := assert.New(t)
+	input := `pending work:                  0 B
+
+waiting
+  io wait duration:            1.00 GiB
+  io wait remaining:           512 MiB
+  duration waited:             10 s
+
+  [<0>] bch2_kthread_io_clock_wait+0x94/0x130 [bcachefs]
+`
+
+	stat, err := parseSysFsRebalanceStatus(input)
+	assert.Nil(err)
+	assert.Equal(&SysFsRebalanceStatus{State: "waiting", Contexts: []SysFsRebalanceContext{}}, stat)
+}
+
+func TestParseSysFsRebalanceStatusContexts(t *testing.T) {
+	assert := assert.New(t)
+	// unknown states and several contexts of a newer kernel
+	input := `pending work:                  1.00 MiB
+
+reconciling
+  reconcile_work: data type==user pos=extents:4096:0:U32_MAX
+    keys moved:                1
+    keys raced:                2
+    bytes seen:                4.00 KiB
+    bytes moved:               4.00 KiB
+    bytes raced:               0 B
+  reconcile_scan: data type==btree pos=inodes:0:0:U32_MAX
+    keys moved:                3
+    keys raced:                0
+    bytes seen:                8.00 KiB
+    bytes moved:               0 B
+    bytes raced:               0 B
+    keys skipped:              5
+    skipped by target
+`
+
+	stat, err := parseSysFsRebalanceStatus(input)
+	// counters unknown to the parser are skipped
+	assert.Nil(err)
+	assert.Equal("reconciling", stat.State)
+	assert.Equal(int64(1048576), stat.PendingWork)
+	assert.Equal([]SysFsRebalanceContext{
+		{Name: "reconcile_work", DataType: "user", Pos: "extents:4096:0:U32_MAX", KeysMoved: 1, KeysRaced: 2, BytesSeen: 4096, BytesMoved: 4096},
+		{Name: "reconcile_scan", DataType: "btree", Pos: "inodes:0:0:U32_MAX", KeysMoved: 3, BytesSeen: 8192},
+	}, stat.Contexts)
+
+	_, err = parseSysFsRebalanceStatus("working\n  rebalance_work: data type==user pos=extents:0:0:U32_MAX\n    keys moved: x\n")
+	var pe *utils.ParseError
+	assert.True(errors.As(err, &pe))
+	assert.Equal(3, pe.Line)
+}
+
+func TestParseSysFsCompressionStatsWithErrors(t *testing.T) {
+	assert := assert.New(t)
+	input := `typetype          compressed    uncompressed     average extent size
+lz4                        0               0                       0
+zstd                   3.32X           9.69T                    119k
+incompressible         11.4T           11.4T                   94.7k
+`
+
+	stat, err := parseSysFsCompressionStats(input)
+	assert.Equal(2, len(stat))
+	assert.Equal("lz4", stat[0].CompressionType)
+	assert.Equal("incompressible", stat[1].CompressionType)
+
+	var pe *utils.ParseError
+	assert.True(errors.As(err, &pe))
+	assert.Equal("compression_stats", pe.Section)
+	assert.Equal(3, pe.Line)
+	assert.Equal("zstd 3.32X 9.69T 119k", pe.Text)
+
+	_, err = parseSysFsCompressionStats("type compressed uncompressed\n")
+	assert.True(errors.As(err, &pe))
+	assert.Equal(1, pe.Line)
 }
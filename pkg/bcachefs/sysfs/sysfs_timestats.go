@@ -1,9 +1,10 @@
 package sysfs
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,46 +15,59 @@ import (
 type SysFsTimeStats map[string]SysFsTimeStat
 
 type SysFsTimeStat struct {
-	Count    int64
-	Duration SysFsTimeStatItem
-	Interval SysFsTimeStatItem
+	Count    int64             `json:"count"`
+	Duration SysFsTimeStatItem `json:"duration"`
+	Interval SysFsTimeStatItem `json:"interval"`
+	// quantiles of the duration, in ascending order
+	Quantiles []SysFsTimeStatQuantile `json:"quantiles"`
+}
+
+type SysFsTimeStatQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"` // in seconds
 }
 
 type SysFsTimeStatItem struct {
-	Min    float64
-	Max    float64
-	Total  float64
-	Mean   float64
-	Stddev float64
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Total  float64 `json:"total"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
 
-	RecentMean   float64
-	RecentStddev float64
+	RecentMean   float64 `json:"recent_mean"`
+	RecentStddev float64 `json:"recent_stddev"`
 }
 
-func ParseSysFsTimeStats(uuid string) (SysFsTimeStats, error) {
-	path := filepath.Join(SYSFS_PATH_PREFIX, uuid, "time_stats")
-	items, err := os.ReadDir(path)
+// ParseSysFsTimeStats parses every file in 'time_stats'.
+// Files which fail to be parsed are omitted from the result and reported
+// in the returned error.
+func ParseSysFsTimeStats(fsys fs.FS, uuid string) (SysFsTimeStats, error) {
+	dir := path.Join(uuid, "time_stats")
+	items, err := fs.ReadDir(fsys, dir)
 	if err != nil {
 		return nil, err
 	}
+	errs := []error{}
 	res := SysFsTimeStats{}
 	for _, item := range items {
-		p := filepath.Join(path, item.Name())
-		data, err := os.ReadFile(p)
+		p := path.Join(dir, item.Name())
+		data, err := fs.ReadFile(fsys, p)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", item.Name(), err)
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", item.Name(), err))
+			continue
 		}
-		s, err := parseSysFsTimeStat(string(data), false)
+		s, err := parseSysFsTimeStat(string(data))
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", item.Name(), err)
+			errs = append(errs, fmt.Errorf("failed to parse '%s': %w", item.Name(), err))
+			continue
 		}
 		res[item.Name()] = *s
 	}
 
-	return res, nil
+	return res, errors.Join(errs...)
 }
 
-func parseSysFsTimeStat(s string, ignoreQuantiles bool) (*SysFsTimeStat, error) {
+func parseSysFsTimeStat(s string) (*SysFsTimeStat, error) {
 	re := regexp.MustCompile(`\s+`)
 	lines := strings.Split(s, "\n")
 	stat := &SysFsTimeStat{}
@@ -61,42 +75,83 @@ func parseSysFsTimeStat(s string, ignoreQuantiles bool) (*SysFsTimeStat, error)
 	var err error
 	for lineIdx < len(lines) {
 		line := re.ReplaceAllString(lines[lineIdx], " ")
+		lineNum := lineIdx + 1
 		seps := strings.Split(line, " ")
 		switch seps[0] {
 		case "count:":
 			lineIdx += 2
+			if len(seps) < 2 {
+				err = fmt.Errorf("missing count")
+				break
+			}
 			stat.Count, err = strconv.ParseInt(seps[1], 10, 64)
 		case "duration":
+			if lineIdx+6 > len(lines) {
+				err = fmt.Errorf("truncated section")
+				break
+			}
 			stat.Duration, err = parseSysFsTimeStatItem(lines[lineIdx+1 : lineIdx+6])
 			lineIdx += 6
 		case "time":
+			if lineIdx+5 > len(lines) {
+				err = fmt.Errorf("truncated section")
+				break
+			}
 			stat.Interval, err = parseSysFsTimeStatItem(lines[lineIdx+1 : lineIdx+5])
 			lineIdx += 5
 		case "":
 			lineIdx += 1
 		case "quantiles":
-			if ignoreQuantiles {
-				lineIdx += 1
-			} else {
-				return nil, fmt.Errorf("unexpected line '%s'", line)
-			}
+			lineIdx += 1
+			stat.Quantiles, err = parseSysFsTimeStatQuantiles(seps[1:])
 		default:
-			return nil, fmt.Errorf("unexpected line '%s'", line)
+			err = fmt.Errorf("unexpected line")
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse '%s': %v", line, err)
+			return nil, utils.NewParseError("time_stats", lineNum, line, err)
 		}
 	}
 
 	return stat, nil
 }
 
+// parseSysFsTimeStatQuantiles parses the fields after 'quantiles', which
+// are the unit like '(us):' followed by the values of the equally spaced
+// quantiles, i.e. 1/16, 2/16, ... 15/16 for the 15 values the kernel prints.
+func parseSysFsTimeStatQuantiles(fields []string) ([]SysFsTimeStatQuantile, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("missing quantiles")
+	}
+	unit := strings.TrimSuffix(strings.TrimPrefix(fields[0], "("), "):")
+	values := []string{}
+	for _, f := range fields[1:] {
+		if f != "" {
+			values = append(values, f)
+		}
+	}
+	res := []SysFsTimeStatQuantile{}
+	for i, v := range values {
+		time, err := utils.ParseTimeWithUnit([]string{v, unit})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, SysFsTimeStatQuantile{
+			Quantile: float64(i+1) / float64(len(values)+1),
+			Value:    time,
+		})
+	}
+	return res, nil
+}
+
 func parseSysFsTimeStatItem(lines []string) (SysFsTimeStatItem, error) {
 	re := regexp.MustCompile(`\s+`)
 	si := SysFsTimeStatItem{}
 	for _, l := range lines {
 		l = re.ReplaceAllString(l, " ")
 		seps := strings.Split(l, " ")
+		if len(seps) < 4 {
+			return si, fmt.Errorf("too few fields in '%s'", l)
+		}
 		time, err := utils.ParseTimeWithUnit(seps[2:4])
 		if err != nil {
 			return si, fmt.Errorf("failed to parse '%s': %v", l, err)
@@ -109,6 +164,9 @@ func parseSysFsTimeStatItem(lines []string) (SysFsTimeStatItem, error) {
 		case "total:":
 			si.Total = time
 		case "mean:", "stddev:":
+			if len(seps) < 6 {
+				return si, fmt.Errorf("missing recent value in '%s'", l)
+			}
 			timeRecent, err := utils.ParseTimeWithUnit(seps[4:6])
 			if err != nil {
 				return si, fmt.Errorf("failed to parse '%s': %v", l, err)
@@ -1,6 +1,8 @@
 package sysfs
 
 import (
+	"errors"
+	"io/fs"
 	"math"
 	"testing"
 
@@ -23,7 +25,7 @@ time between events
   mean:                     475 ms       1586 ms
   stddev:                  1909 ms       1679 us
 `
-	stat, err := parseSysFsTimeStat(input, false)
+	stat, err := parseSysFsTimeStat(input)
 	assert.Nil(err)
 	assert.Equal(float64(88)*math.Pow10(-6), stat.Duration.Min)
 	assert.Equal(float64(2*60), stat.Duration.Max)
@@ -39,4 +41,32 @@ time between events
 	assert.Equal(float64(1586)*math.Pow10(-3), stat.Interval.RecentMean)
 	assert.Equal(float64(1909)*math.Pow10(-3), stat.Interval.Stddev)
 	assert.Equal(float64(1679)*math.Pow10(-6), stat.Interval.RecentStddev)
+	assert.Nil(stat.Quantiles)
+}
+
+func TestParseSysFsTimeStatQuantiles(t *testing.T) {
+	assert := assert.New(t)
+	stat, err := parseSysFsTimeStat(testTimeStat)
+	assert.Nil(err)
+	assert.Equal(15, len(stat.Quantiles))
+	assert.Equal(SysFsTimeStatQuantile{Quantile: 1.0 / 16, Value: float64(88) * math.Pow10(-6)}, stat.Quantiles[0])
+	assert.Equal(SysFsTimeStatQuantile{Quantile: 15.0 / 16, Value: float64(2100) * math.Pow10(-6)}, stat.Quantiles[14])
+
+	_, err = parseSysFsTimeStat("quantiles (us):\n")
+	assert.NotNil(err)
+	_, err = parseSysFsTimeStat("quantiles (us): 1 x 3\n")
+	assert.NotNil(err)
+}
+
+func TestParseSysFsTimeStats(t *testing.T) {
+	assert := assert.New(t)
+	root := testSysFs()
+	stats, err := ParseSysFsTimeStats(root, testUuid)
+	assert.Nil(err)
+	assert.Equal(1, len(stats))
+	assert.Equal(int64(484251), stats["blocked_journal_max_in_flight"].Count)
+
+	delete(root, testUuid+"/time_stats/blocked_journal_max_in_flight")
+	_, err = ParseSysFsTimeStats(root, testUuid)
+	assert.True(errors.Is(err, fs.ErrNotExist))
 }
@@ -0,0 +1,135 @@
+package sysfs
+
+import (
+	"testing/fstest"
+)
+
+const testUuid = "a9da1e6e-d4e5-4717-a520-408c8af4b084"
+
+const testTimeStat = `count:     484251
+                       since mount        recent
+duration of events
+  min:                       88 us
+  max:                        2 m
+  total:                     47 h
+  mean:                     353 ms         11 ms
+  stddev:                     2 s           5 ms
+time between events
+  min:                       10 ns
+  max:                        9 m
+  mean:                     475 ms       1586 ms
+  stddev:                  1909 ms       1679 us
+quantiles (us):  88 94 103 110 115 127 139 150 168 189 211 260 402 987 2100
+`
+
+const testIoDone = `read:
+sb          :      856064
+journal     :           0
+btree       :200642920448
+user        :2338190483456
+write:
+sb          :     4088832
+journal     :     7426048
+btree       : 10873405440
+user        :746460282880
+`
+
+const testIoErrors = `IO errors since filesystem creation
+  read:    1
+  write:   2
+  checksum:3
+IO errors since 7 y ago
+  read:    0
+  write:   1
+  checksum:0
+`
+
+const testBlockStat = `  148230    12010 96523554   620180   301822    99751 181355744  2711036        0   741196  3490368     1024        0  2097152      120    20650    159032
+`
+
+const testAllocDebug = `capacity                15625000000
+reserved                1093750000
+hidden                  12582912
+btree                   18874368000
+data                    9712345678
+cached                  0
+reserved                0
+online_reserved         4096
+nr_inodes               1234567
+
+freelist_wait           empty
+open buckets allocated  12
+open buckets total      1024
+open_buckets_wait       empty
+open_buckets_btree      3
+open_buckets_user       9
+btree reserve cache     32
+`
+
+const testDevAllocDebug = `            buckets         sectors      fragmented
+free        7412880               0               0
+sb                7            6152               0
+journal        8192         4194304               0
+btree         12034         6123456           38912
+user         198000     99999999999            1234
+cached            0               0               0
+need_discard      3               0               0
+capacity    7630915
+
+reserves:
+stripe       238468
+normal       119242
+copygc           23
+btree            11
+
+open buckets              7
+buckets to invalidate     0
+`
+
+// testSysFs returns a sysfs tree of a filesystem with an online member
+// 'dev-0' and a member 'dev-2' which lacks most files
+func testSysFs() fstest.MapFS {
+	fs := fstest.MapFS{
+		"not-a-filesystem/dev-0/label": {Data: []byte("ssd.0\n")},
+	}
+	add := func(name, data string) {
+		fs[testUuid+"/"+name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	add("btree_cache_size", "19.1G\n")
+	add("btree_write_stats", "                   nr        size\ninitial:           4243      129k\n")
+	add("compression_stats", `typetype          compressed    uncompressed     average extent size
+zstd                   3.32T           9.69T                    119k
+`)
+	add("counters/io_read", "since mount:                   7.69G\nsince filesystem creation:     176T\n")
+	add("counters/bucket_alloc", "since mount:                   1\nsince filesystem creation:     551\n")
+	add("errors", "btree_node_read_error                        3  2024-10-02T13:22:08\n(unknown error 999)                          1  2025-01-15T00:03:41\n")
+	add("options/compression", "zstd:3\n")
+	add("options/metadata_checksum", "none [crc32c] crc64 xxhash\n")
+	add("options/metadata_replicas", "2\n")
+	add("options/foreground_target", "ssd\n")
+	add("options/block_size", "4.00 KiB\n")
+	add("internal/alloc_debug", testAllocDebug)
+	add("dev-0/alloc_debug", testDevAllocDebug)
+	add("time_stats/blocked_journal_max_in_flight", testTimeStat)
+	add("dev-0/label", "hdd.hdd1\n")
+	add("dev-0/uuid", "a2b0a1d4-2f5e-4b3d-8e0b-7d6c5f4e3a21\n")
+	add("dev-0/bucket_size", "512k\n")
+	add("dev-0/nbuckets", "7630916\n")
+	add("dev-0/first_bucket", "1\n")
+	add("dev-0/durability", "1\n")
+	add("dev-0/state", "[rw] ro failed spare\n")
+	add("dev-0/data_allowed", "journal,btree,user\n")
+	add("dev-0/has_data", "sb,journal,btree,user\n")
+	add("dev-0/discard", "1\n")
+	add("dev-0/rotational", "1\n")
+	add("dev-0/io_done", testIoDone)
+	add("dev-0/io_errors", testIoErrors)
+	add("dev-0/io_latency_stats_read", testTimeStat)
+	add("dev-0/io_latency_stats_write", testTimeStat)
+	add("dev-0/block/dev", "8:48\n")
+	add("dev-0/block/uevent", "MAJOR=8\nMINOR=48\nDEVNAME=sdd\nDEVTYPE=disk\n")
+	add("dev-0/block/stat", testBlockStat)
+	add("dev-2/label", "hdd.hdd3\n")
+	add("dev-2/durability", "2\n")
+	return fs
+}
@@ -1,73 +1,86 @@
 package bcachefs
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
 )
 
 type FsUsage struct {
-	FileSystem     string
-	Path           string
-	Capacity       int
-	Used           int
-	OnlineReserved int
-	Replicas       []FsUsageReplica
-	Compressions   []FsUsageCompression
-	Btrees         []FsUsageBtree
-	Reconcile      map[string]FsUsageReconcile
-	Devices        []FsUsageDevice
+	FileSystem     string                      `json:"file_system"`
+	Path           string                      `json:"path"`
+	Capacity       int                         `json:"capacity"`
+	Used           int                         `json:"used"`
+	OnlineReserved int                         `json:"online_reserved"`
+	Replicas       []FsUsageReplica            `json:"replicas"`
+	Degraded       []FsUsageDegraded           `json:"degraded"`
+	Compressions   []FsUsageCompression        `json:"compressions"`
+	Btrees         []FsUsageBtree              `json:"btrees"`
+	Reconcile      map[string]FsUsageReconcile `json:"reconcile"`
+	Devices        []FsUsageDevice             `json:"devices"`
 }
 
 type FsUsageReplica struct {
-	DataType      string
-	RequiredTotal string
-	Durability    string
-	Devices       string
-	Size          int
+	DataType      string `json:"data_type"`
+	RequiredTotal string `json:"required_total"`
+	Durability    string `json:"durability"`
+	Devices       string `json:"devices"`
+	Size          int    `json:"size"`
+}
+
+// FsUsageDegraded is a cell of 'Data by durability desired and amount degraded'
+type FsUsageDegraded struct {
+	// e.g. '2' for '2x', or 'cached' and 'reserved'
+	DurabilityDesired string `json:"durability_desired"`
+	DegradedBy        int    `json:"degraded_by"`
+	Size              int    `json:"size"`
 }
 
 type FsUsageCompression struct {
-	CompressionType   string
-	Comporessed       int64
-	Uncompressed      int64
-	AverageExtentSize int64
+	CompressionType   string `json:"compression_type"`
+	Comporessed       int64  `json:"compressed"`
+	Uncompressed      int64  `json:"uncompressed"`
+	AverageExtentSize int64  `json:"average_extent_size"`
 }
 
 type FsUsageBtree struct {
-	DataType string
-	Size     int
+	DataType string `json:"data_type"`
+	Size     int    `json:"size"`
 }
 
 type FsUsageReconcile struct {
-	Data     int
-	Metadata int
+	Data     int `json:"data"`
+	Metadata int `json:"metadata"`
 }
 
 type FsUsageDevice struct {
-	Device string
-	Label  string
-	Datas  []FsUsageDeviceData
+	Device string              `json:"device"`
+	Label  string              `json:"label"`
+	Datas  []FsUsageDeviceData `json:"data"`
 }
 
 type FsUsageDeviceData struct {
-	DataType      string
-	Size          int
-	Buckets       int
-	HasFragmented bool
-	Fragmented    int
+	DataType      string `json:"data_type"`
+	Size          int    `json:"size"`
+	Buckets       int    `json:"buckets"`
+	HasFragmented bool   `json:"has_fragmented"`
+	Fragmented    int    `json:"fragmented"`
 }
 
-func ParseFsUsage(path, results string) *FsUsage {
+// ParseFsUsage parses the output of 'bcachefs fs usage'.
+// Lines which cannot be parsed are skipped and reported as *utils.ParseError
+// in the returned error, so the result holds everything that could be parsed.
+func ParseFsUsage(path, results string) (*FsUsage, error) {
 	fs := &FsUsage{
-		Path: path,
+		Path:      path,
+		Reconcile: map[string]FsUsageReconcile{},
 	}
 
-	var err error
-	count := 0
-
+	errs := []error{}
 	re := regexp.MustCompile(`\s+`)
 	lines := strings.Split(results, "\n")
 	idx := 0
@@ -81,80 +94,197 @@ func ParseFsUsage(path, results string) *FsUsage {
 
 		seps := strings.Split(line, " ")
 
+		var err error
+		count := 1
 		if strings.HasPrefix(line, "Filesystem:") {
-			fs.FileSystem = seps[1]
-			idx += 1
-		} else if strings.HasPrefix(line, "Size:") {
-			fs.Capacity, err = strconv.Atoi(seps[1])
-			if err != nil {
-				log.Fatalf("Failed to parse '%s': %v", line, err)
+			if len(seps) < 2 {
+				err = utils.NewParseError("filesystem", idx+1, line, fmt.Errorf("missing uuid"))
+			} else {
+				fs.FileSystem = seps[1]
 			}
-			idx += 1
+		} else if strings.HasPrefix(line, "Size:") {
+			fs.Capacity, err = parseFsUsageInt(seps, 1, idx+1, line)
 		} else if strings.HasPrefix(line, "Used:") {
-			fs.Used, err = strconv.Atoi(seps[1])
-			if err != nil {
-				log.Fatalf("Failed to parse '%s': %v", line, err)
-			}
-			idx += 1
+			fs.Used, err = parseFsUsageInt(seps, 1, idx+1, line)
 		} else if strings.HasPrefix(line, "Online reserved:") {
-			fs.OnlineReserved, err = strconv.Atoi(seps[2])
-			if err != nil {
-				log.Fatalf("Failed to parse '%s': %v", line, err)
-			}
-			idx += 1
+			fs.OnlineReserved, err = parseFsUsageInt(seps, 2, idx+1, line)
 		} else if strings.HasPrefix(line, "Data type") {
-			fs.Replicas, count = collectAccountings(lines[idx:])
-			idx += count
+			fs.Replicas, count, err = collectAccountings(lines[idx:], idx)
 		} else if strings.HasPrefix(line, "Compression:") {
-			fs.Compressions, count = collectCompressions(lines[idx:])
-			idx += count
+			fs.Compressions, count, err = collectCompressions(lines[idx:], idx)
 		} else if strings.HasPrefix(line, "Btree usage:") {
-			fs.Btrees, count = collectBtree(lines[idx:])
-			idx += count
+			fs.Btrees, count, err = collectBtree(lines[idx:], idx)
 		} else if strings.HasPrefix(line, "Pending reconcile:") {
-			fs.Reconcile, count = collectReconcile(lines[idx:])
-			idx += count
-		} else if strings.HasPrefix(line, "Data by durability desired and amount degraded:") {
-			for idx < len(lines) && lines[idx] != "" {
-				idx += 1
+			fs.Reconcile, count, err = collectReconcile(lines[idx:], idx)
+		} else if strings.HasPrefix(line, "Pending rebalance work:") {
+			var r *FsUsageReconcile
+			r, count, err = collectRebalanceWork(lines[idx:], idx)
+			if r != nil {
+				fs.Reconcile["rebalance_work"] = *r
 			}
+		} else if strings.HasPrefix(line, "Data by durability desired and amount degraded:") {
+			fs.Degraded, count, err = collectDegraded(lines[idx:], idx)
 		} else {
-			d, count := collectDevice(lines[idx:])
-			fs.Devices = append(fs.Devices, d)
-			idx += count
+			var d *FsUsageDevice
+			d, count, err = collectDevice(lines[idx:], idx)
+			if d != nil {
+				fs.Devices = append(fs.Devices, *d)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		idx += count
+	}
+	return fs, errors.Join(errs...)
+}
+
+func parseFsUsageInt(seps []string, pos, lineNum int, line string) (int, error) {
+	if len(seps) <= pos {
+		return 0, utils.NewParseError("filesystem", lineNum, line, fmt.Errorf("missing value"))
+	}
+	v, err := strconv.Atoi(seps[pos])
+	if err != nil {
+		return 0, utils.NewParseError("filesystem", lineNum, line, err)
+	}
+	return v, nil
+}
+
+// skipSection returns the number of lines up to the next empty line
+func skipSection(lines []string) int {
+	count := 0
+	for count < len(lines) && lines[count] != "" {
+		count += 1
+	}
+	return count
+}
+
+// return the number of processed lines
+// The table is like
+//
+//	          undegraded       -1x
+//	1x:           123456
+//	2x:           123456     12345
+//
+// where cells are right aligned to the header and may be empty, so values
+// are assigned to the header column whose end is the closest.
+func collectDegraded(lines []string, offset int) ([]FsUsageDegraded, int, error) {
+	if len(lines) < 2 || lines[1] == "" {
+		return nil, 1, utils.NewParseError("degraded", offset+1, lines[0], fmt.Errorf("missing header"))
+	}
+	fieldRe := regexp.MustCompile(`\S+`)
+	type column struct {
+		end        int
+		degradedBy int
+	}
+	columns := []column{}
+	for _, loc := range fieldRe.FindAllStringIndex(lines[1], -1) {
+		name := lines[1][loc[0]:loc[1]]
+		c := column{end: loc[1]}
+		if name != "undegraded" {
+			n, ok := strings.CutPrefix(name, "-")
+			if ok {
+				n, ok = strings.CutSuffix(n, "x")
+			}
+			var err error
+			c.degradedBy, err = strconv.Atoi(n)
+			if !ok || err != nil {
+				return nil, skipSection(lines), utils.NewParseError("degraded", offset+2, lines[1], fmt.Errorf("unexpected column '%s'", name))
+			}
+		}
+		columns = append(columns, c)
+	}
+
+	errs := []error{}
+	res := []FsUsageDegraded{}
+	count := 2
+	for count < len(lines) {
+		line := lines[count]
+		if line == "" {
+			break
+		}
+		count += 1
+		lineNum := offset + count
+		label, values, ok := strings.Cut(line, ":")
+		if !ok {
+			errs = append(errs, utils.NewParseError("degraded", lineNum, line, fmt.Errorf("missing ':'")))
+			continue
+		}
+		durability := strings.TrimSpace(label)
+		if d, ok := strings.CutSuffix(durability, "x"); ok {
+			durability = d
+		}
+		for _, loc := range fieldRe.FindAllStringIndex(values, -1) {
+			size, err := strconv.Atoi(values[loc[0]:loc[1]])
+			if err != nil {
+				errs = append(errs, utils.NewParseError("degraded", lineNum, line, err))
+				continue
+			}
+			end := len(label) + 1 + loc[1]
+			c := columns[0]
+			for _, cc := range columns[1:] {
+				if abs(cc.end-end) < abs(c.end-end) {
+					c = cc
+				}
+			}
+			res = append(res, FsUsageDegraded{
+				DurabilityDesired: durability,
+				DegradedBy:        c.degradedBy,
+				Size:              size,
+			})
 		}
 	}
-	return fs
+
+	return res, count, errors.Join(errs...)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
 }
 
 // return the number of processed lines
-func collectAccountings(lines []string) ([]FsUsageReplica, int) {
+// offset is the index of lines[0] in the whole output and is used for error reporting
+func collectAccountings(lines []string, offset int) ([]FsUsageReplica, int, error) {
 	re := regexp.MustCompile(`\s+`)
 	line := re.ReplaceAllString(lines[0], " ")
 	if line != "Data type Required/total Durability Devices" {
-		log.Fatalf("unexpected format: %s", line)
+		return nil, skipSection(lines), utils.NewParseError("replicas", offset+1, line, fmt.Errorf("unexpected format"))
 	}
 
+	errs := []error{}
 	res := []FsUsageReplica{}
 	count := 1
-	for {
+	for count < len(lines) {
 		line := re.ReplaceAllString(lines[count], " ")
 		if line == "" {
 			break
 		}
 		count += 1
+		lineNum := offset + count
 
 		seps := strings.SplitN(line, " ", 4)
 		//fmt.Println(seps)
+		if len(seps) < 4 {
+			errs = append(errs, utils.NewParseError("replicas", lineNum, line, fmt.Errorf("too few fields")))
+			continue
+		}
 
 		dataType := strings.ReplaceAll(seps[0], ":", "")
 		requiredTotal := seps[1]
 		if dataType == "reserved" {
 			devices := seps[2]
+			if len(devices) < 2 {
+				errs = append(errs, utils.NewParseError("replicas", lineNum, line, fmt.Errorf("invalid devices '%s'", devices)))
+				continue
+			}
 			devices = devices[1 : len(devices)-1]
 			size, err := strconv.Atoi(seps[3])
 			if err != nil {
-				log.Fatalf("failed to parse '%s': %v", line, err)
+				errs = append(errs, utils.NewParseError("replicas", lineNum, line, err))
+				continue
 			}
 			res = append(res, FsUsageReplica{
 				DataType:      dataType,
@@ -168,11 +298,13 @@ func collectAccountings(lines []string) ([]FsUsageReplica, int) {
 			re := regexp.MustCompile(`\[([^]]+)\]\s*(\d+)`)
 			matches := re.FindStringSubmatch(seps[3])
 			if len(matches) != 3 {
-				log.Fatalf("failed to parse '%s': %v", line, matches)
+				errs = append(errs, utils.NewParseError("replicas", lineNum, line, fmt.Errorf("unexpected devices and size: %v", matches)))
+				continue
 			}
 			size, err := strconv.Atoi(matches[2])
 			if err != nil {
-				log.Fatalf("failed to parse '%s': %v", line, err)
+				errs = append(errs, utils.NewParseError("replicas", lineNum, line, err))
+				continue
 			}
 
 			res = append(res, FsUsageReplica{
@@ -185,30 +317,36 @@ func collectAccountings(lines []string) ([]FsUsageReplica, int) {
 		}
 	}
 
-	return res, count
+	return res, count, errors.Join(errs...)
 }
 
 // return the number of processed lines
-func collectCompressions(lines []string) ([]FsUsageCompression, int) {
+func collectCompressions(lines []string, offset int) ([]FsUsageCompression, int, error) {
 	re := regexp.MustCompile(`\s+`)
+	if len(lines) < 2 {
+		return nil, len(lines), utils.NewParseError("compression", offset+1, lines[0], fmt.Errorf("missing header"))
+	}
 	line := re.ReplaceAllString(lines[1], " ")
 	if line != "type compressed uncompressed average extent size" {
-		log.Fatalf("unexpected format: %s", line)
+		return nil, skipSection(lines), utils.NewParseError("compression", offset+2, line, fmt.Errorf("unexpected format"))
 	}
 
 	compTypeCandidates := []string{"none", "lz4", "zstd", "gzip", "incompressible"}
+	errs := []error{}
 	count := 2
 	res := []FsUsageCompression{}
-	for {
+	for count < len(lines) {
 		line := re.ReplaceAllString(lines[count], " ")
 		if line == "" {
 			break
 		}
 		count += 1
+		lineNum := offset + count
 		seps := strings.Split(line, " ")
 		compType := ""
 		if len(seps) < 3 {
-			log.Fatalf("unexpected line: %s", line)
+			errs = append(errs, utils.NewParseError("compression", lineNum, line, fmt.Errorf("too few fields")))
+			continue
 		} else if len(seps) == 3 {
 			for _, candidate := range compTypeCandidates {
 				if strings.HasPrefix(seps[0], candidate) {
@@ -218,25 +356,29 @@ func collectCompressions(lines []string) ([]FsUsageCompression, int) {
 				}
 			}
 			if compType == "" {
-				log.Fatalf("line with unknown compression type: %s", line)
+				errs = append(errs, utils.NewParseError("compression", lineNum, line, fmt.Errorf("unknown compression type")))
+				continue
 			}
 
-		} else if len(seps) == 4 {
+		} else {
 			compType = seps[0]
 			seps = seps[1:]
 		}
 
 		compressed, err := strconv.ParseInt(seps[0], 10, 64)
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("compression", lineNum, line, err))
+			continue
 		}
 		uncompressed, err := strconv.ParseInt(seps[1], 10, 64)
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("compression", lineNum, line, err))
+			continue
 		}
 		avgExtent, err := strconv.ParseInt(seps[2], 10, 64)
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("compression", lineNum, line, err))
+			continue
 		}
 
 		res = append(res, FsUsageCompression{
@@ -247,73 +389,101 @@ func collectCompressions(lines []string) ([]FsUsageCompression, int) {
 		})
 	}
 
-	return res, count
+	return res, count, errors.Join(errs...)
 }
 
-func collectBtree(lines []string) ([]FsUsageBtree, int) {
+func collectBtree(lines []string, offset int) ([]FsUsageBtree, int, error) {
 	re := regexp.MustCompile(`\s+`)
+	errs := []error{}
 	res := []FsUsageBtree{}
 	count := 1
-	for {
+	for count < len(lines) {
 		line := re.ReplaceAllString(lines[count], " ")
 		if line == "" {
 			break
 		}
 		count += 1
+		lineNum := offset + count
 		seps := strings.Split(line, ":")
+		if len(seps) < 2 {
+			errs = append(errs, utils.NewParseError("btree", lineNum, line, fmt.Errorf("missing ':'")))
+			continue
+		}
 		dataType := strings.TrimSpace(seps[0])
 		size, err := strconv.Atoi(strings.TrimSpace(seps[1]))
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("btree", lineNum, line, err))
+			continue
 		}
 		res = append(res, FsUsageBtree{
 			DataType: dataType,
 			Size:     size,
 		})
 	}
-	return res, count
+	return res, count, errors.Join(errs...)
 }
 
-func collectReconcile(lines []string) (map[string]FsUsageReconcile, int) {
+func collectReconcile(lines []string, offset int) (map[string]FsUsageReconcile, int, error) {
 	re := regexp.MustCompile(`\s+`)
+	errs := []error{}
 	res := map[string]FsUsageReconcile{}
 	count := 1
-	for {
+	for count < len(lines) {
 		line := re.ReplaceAllString(lines[count], " ")
 		if line == "" {
 			break
 		}
 		count += 1
+		lineNum := offset + count
 		seps := strings.Split(line, ":")
 		if len(seps) < 2 {
-			log.Fatalf("unexpected line: %s", line)
+			errs = append(errs, utils.NewParseError("reconcile", lineNum, line, fmt.Errorf("missing ':'")))
+			continue
 		}
 		dataType := strings.TrimSpace(seps[0])
 		seps = strings.SplitN(strings.TrimSpace(seps[1]), " ", 2)
 		if len(seps) < 2 {
-			log.Fatalf("unexpected line on values: %s", line)
+			errs = append(errs, utils.NewParseError("reconcile", lineNum, line, fmt.Errorf("too few values")))
+			continue
 		}
 		dataSize, err := strconv.Atoi(strings.TrimSpace(seps[0]))
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("reconcile", lineNum, line, err))
+			continue
 		}
 		metadataSize, err := strconv.Atoi(strings.TrimSpace(seps[1]))
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("reconcile", lineNum, line, err))
+			continue
 		}
 		res[dataType] = FsUsageReconcile{
 			Data:     dataSize,
 			Metadata: metadataSize,
 		}
 	}
-	return res, count
+	return res, count, errors.Join(errs...)
 }
 
-func collectDevice(lines []string) (FsUsageDevice, int) {
+// collectRebalanceWork parses the data pending rebalance, printed on the
+// line after the header by versions before reconcile.
+func collectRebalanceWork(lines []string, offset int) (*FsUsageReconcile, int, error) {
+	if len(lines) < 2 {
+		return nil, 1, utils.NewParseError("rebalance_work", offset+1, lines[0], fmt.Errorf("missing value"))
+	}
+	line := strings.TrimSpace(lines[1])
+	size, err := strconv.Atoi(line)
+	if err != nil {
+		return nil, 2, utils.NewParseError("rebalance_work", offset+2, line, err)
+	}
+	return &FsUsageReconcile{Data: size}, 2, nil
+}
+
+// collectDevice returns nil device if the header of the section is not understood
+func collectDevice(lines []string, offset int) (*FsUsageDevice, int, error) {
 	re := regexp.MustCompile(`\s+`)
 	line := re.ReplaceAllString(lines[0], " ")
 	seps := strings.Split(line, ":")
-	res := FsUsageDevice{
+	res := &FsUsageDevice{
 		Datas: []FsUsageDeviceData{},
 	}
 
@@ -324,44 +494,59 @@ func collectDevice(lines []string) (FsUsageDevice, int) {
 	} else {
 		// 'hdd.hdd1 (device 0)'
 		deviceSep := strings.SplitN(seps[0], " ", 2)
+		if len(deviceSep) < 2 {
+			return nil, skipSection(lines), utils.NewParseError("device", offset+1, line, fmt.Errorf("unexpected line"))
+		}
 		res.Label = deviceSep[0]
 		res.Device = regexp.MustCompile(`\(|\)`).ReplaceAllString(deviceSep[1], "")
 	}
 
+	if len(lines) < 2 {
+		return nil, len(lines), utils.NewParseError("device", offset+1, line, fmt.Errorf("missing header"))
+	}
 	count := 1
 	line = lines[count]
 	count += 1
 	line = re.ReplaceAllString(line, " ")
 	if line != " data buckets fragmented" {
-		log.Fatalf("unexpected format: %s", line)
+		return nil, skipSection(lines), utils.NewParseError("device", offset+count, line, fmt.Errorf("unexpected format"))
 	}
 
 	//fmt.Printf("label=%s device=%s\n", label, device)
-	for {
+	errs := []error{}
+	for count < len(lines) {
 		line = lines[count]
 		count += 1
 		if line == "" {
 			break
 		}
+		lineNum := offset + count
 		line = re.ReplaceAllString(line, " ")
 		seps = strings.Split(line, " ")
 		if len(seps) < 3 {
-			log.Fatalf("unexpected line: %s", line)
+			errs = append(errs, utils.NewParseError("device", lineNum, line, fmt.Errorf("too few fields")))
+			continue
 		}
 		if seps[1] == "bucket" && seps[2] == "size:" {
 			// 'bucket size:' is ignored
 			continue
 		}
+		if len(seps) < 4 {
+			errs = append(errs, utils.NewParseError("device", lineNum, line, fmt.Errorf("too few fields")))
+			continue
+		}
 
 		dataType := strings.ReplaceAll(seps[1], ":", "")
 		dataSize, err := strconv.Atoi(seps[2])
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("device", lineNum, line, err))
+			continue
 		}
 
 		buckets, err := strconv.Atoi(seps[3])
 		if err != nil {
-			log.Fatalf("unexpected line: %s: %v", line, err)
+			errs = append(errs, utils.NewParseError("device", lineNum, line, err))
+			continue
 		}
 
 		data := FsUsageDeviceData{
@@ -372,7 +557,8 @@ func collectDevice(lines []string) (FsUsageDevice, int) {
 		if len(seps) > 4 && seps[4] != "" {
 			fragmented, err := strconv.Atoi(seps[4])
 			if err != nil {
-				log.Fatalf("unexpected line: %s: %v", line, err)
+				errs = append(errs, utils.NewParseError("device", lineNum, line, err))
+				continue
 			}
 			data.HasFragmented = true
 			data.Fragmented = fragmented
@@ -380,5 +566,5 @@ func collectDevice(lines []string) (FsUsageDevice, int) {
 		res.Datas = append(res.Datas, data)
 	}
 
-	return res, count
+	return res, count, errors.Join(errs...)
 }
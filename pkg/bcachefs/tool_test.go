@@ -1,10 +1,13 @@
 package bcachefs
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/naoki9911/bcachefs_exporter/pkg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -54,7 +57,8 @@ hdd.hdd1 (device 0):             sdd              rw    79%
 `
 
 	assert := assert.New(t)
-	fsUsage := ParseFsUsage("/tank", input)
+	fsUsage, err := ParseFsUsage("/tank", input)
+	assert.Nil(err)
 
 	assert.Equal("a9da1e6e-d4e5-4717-a520-408c8af4b084", fsUsage.FileSystem)
 	assert.Equal(89243210303488, fsUsage.Capacity)
@@ -78,6 +82,13 @@ hdd.hdd1 (device 0):             sdd              rw    79%
 		assert.Equal(replica[4], strconv.Itoa(fsUsage.Replicas[idx].Size))
 	}
 
+	assert.Equal([]FsUsageDegraded{
+		{DurabilityDesired: "1", DegradedBy: 0, Size: 55338970490880},
+		{DurabilityDesired: "2", DegradedBy: 0, Size: 14201918887936},
+		{DurabilityDesired: "cached", DegradedBy: 0, Size: 1720875831296},
+		{DurabilityDesired: "reserved", DegradedBy: 0, Size: 5181931520},
+	}, fsUsage.Degraded)
+
 	comps := [][]string{
 		{"zstd", "3629187407872", "10558477742080", "123627"},
 		{"incompressible", "35909528035328", "35909528035328", "79440"},
@@ -139,3 +150,81 @@ hdd.hdd1 (device 0):             sdd              rw    79%
 		}
 	}
 }
+
+func TestParseDegraded(t *testing.T) {
+	input := `Data by durability desired and amount degraded:
+          undegraded       -1x       -2x
+1x:          1048576
+2x:            65536      4096
+3x:                                  512
+cached:      2097152
+`
+
+	assert := assert.New(t)
+	fsUsage, err := ParseFsUsage("/tank", input)
+	assert.Nil(err)
+	assert.Equal([]FsUsageDegraded{
+		{DurabilityDesired: "1", DegradedBy: 0, Size: 1048576},
+		{DurabilityDesired: "2", DegradedBy: 0, Size: 65536},
+		{DurabilityDesired: "2", DegradedBy: 1, Size: 4096},
+		{DurabilityDesired: "3", DegradedBy: 2, Size: 512},
+		{DurabilityDesired: "cached", DegradedBy: 0, Size: 2097152},
+	}, fsUsage.Degraded)
+
+	_, err = ParseFsUsage("/tank", strings.Replace(input, "-2x", "-two", 1))
+	assert.NotNil(err)
+}
+
+func TestParseWithErrors(t *testing.T) {
+	input := `Filesystem: a9da1e6e-d4e5-4717-a520-408c8af4b084
+Size:                 89243210303488
+Used:                 unknown
+Online reserved:            13135872
+
+Compression:
+type              compressed    uncompressed     average extent size
+zstd           3629187407872  10558477742080                  123627
+brotli1 2 3
+
+Btree usage:
+extents:        195974660096
+`
+
+	assert := assert.New(t)
+	fsUsage, err := ParseFsUsage("/tank", input)
+	assert.NotNil(err)
+
+	assert.Equal("a9da1e6e-d4e5-4717-a520-408c8af4b084", fsUsage.FileSystem)
+	assert.Equal(89243210303488, fsUsage.Capacity)
+	assert.Equal(13135872, fsUsage.OnlineReserved)
+	assert.Equal(1, len(fsUsage.Compressions))
+	assert.Equal(1, len(fsUsage.Btrees))
+
+	var pe *utils.ParseError
+	assert.True(errors.As(err, &pe))
+	assert.Equal("filesystem", pe.Section)
+	assert.Equal(3, pe.Line)
+	assert.Equal("Used: unknown", pe.Text)
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	assert.True(ok)
+	errs := joined.Unwrap()
+	assert.Equal(2, len(errs))
+	assert.True(errors.As(errs[1], &pe))
+	assert.Equal("compression", pe.Section)
+	assert.Equal(9, pe.Line)
+	assert.Equal("brotli1 2 3", pe.Text)
+}
+
+func TestParseFsUsageRebalanceWork(t *testing.T) {
+	assert := assert.New(t)
+	input := `Filesystem: a9da1e6e-d4e5-4717-a520-408c8af4b084
+Size:                  19454029955072
+
+Pending rebalance work:
+65536
+`
+	fsUsage, err := ParseFsUsage("/tank", input)
+	assert.Nil(err)
+	assert.Equal(map[string]FsUsageReconcile{"rebalance_work": {Data: 65536}}, fsUsage.Reconcile)
+}
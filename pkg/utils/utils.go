@@ -66,16 +66,18 @@ func ParseTimeWithUnit(s []string) (float64, error) {
 }
 
 var timeUnits = map[string]float64{
-	"ns":  math.Pow10(-9),
-	"us":  math.Pow10(-6),
-	"ms":  math.Pow10(-3),
-	"s":   1,
-	"m":   60,
-	"h":   60 * 60,
-	"d":   60 * 60 * 24,
-	"w":   60 * 60 * 24 * 7,
-	"y":   60 * 60 * 24 * 365.25,
-	"eon": math.NaN(),
+	"ns": math.Pow10(-9),
+	"us": math.Pow10(-6),
+	"ms": math.Pow10(-3),
+	"s":  1,
+	"m":  60,
+	"h":  60 * 60,
+	"d":  60 * 60 * 24,
+	"w":  60 * 60 * 24 * 7,
+	"y":  60 * 60 * 24 * 365.25,
+	// U64_MAX nanoseconds, which the kernel prints for durations longer
+	// than years. Unlike NaN, it can be encoded to JSON.
+	"eon": math.MaxUint64 * 1e-9,
 }
 
 func stringTimeUnitToInt(u string) (float64, error) {
@@ -85,3 +87,31 @@ func stringTimeUnitToInt(u string) (float64, error) {
 	}
 	return ret, nil
 }
+
+// ParseError describes a piece of input that a parser could not understand.
+type ParseError struct {
+	Section string // section or file the text belongs to
+	Line    int    // 1-based line number, 0 if unknown
+	Text    string // offending text
+	Err     error
+}
+
+func NewParseError(section string, line int, text string, err error) *ParseError {
+	return &ParseError{
+		Section: section,
+		Line:    line,
+		Text:    text,
+		Err:     err,
+	}
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: '%s': %v", e.Section, e.Text, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: '%s': %v", e.Section, e.Line, e.Text, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}